@@ -7,10 +7,17 @@ document.addEventListener('DOMContentLoaded', () => {
     // ── State ──────────────────────────────────────────────────────────────
     let authToken = localStorage.getItem('authToken');
     let currentUsername = localStorage.getItem('currentUsername');
+    let deviceId = localStorage.getItem('deviceId');
+    if (!deviceId) {
+        deviceId = crypto.randomUUID ? crypto.randomUUID() : String(Date.now()) + Math.random().toString(16).slice(2);
+        localStorage.setItem('deviceId', deviceId);
+    }
     let webSocket = null;
     let currentChatId = null;
     let chats = {};
     let messages = {};
+    // Last seen sequence number per chat, sent on reconnect to replay missed messages
+    let lastSeq = {};
 
     // ── DOM refs ───────────────────────────────────────────────────────────
     const authContainer       = document.getElementById('auth-container');
@@ -36,6 +43,7 @@ document.addEventListener('DOMContentLoaded', () => {
     const chatListUl            = document.getElementById('chat-list');
     const messagesContainer     = document.getElementById('messages-container');
     const currentChatNameH2     = document.getElementById('current-chat-name');
+    const typingIndicatorP      = document.getElementById('typing-indicator');
 
     const logoutScreen          = document.getElementById('logout-screen');
     const logoutButton          = document.getElementById('logout-button');
@@ -57,6 +65,9 @@ document.addEventListener('DOMContentLoaded', () => {
 
     const API_BASE_URL = window.location.origin;
     const WS_BASE_URL  = API_BASE_URL.replace(/^http/, 'ws');
+    const WS_SUBPROTOCOL = 'messenger.v1.json';
+    // Frame limit of servers that don't send it in the hello event
+    const DEFAULT_MAX_FRAME_SIZE = 4096;
 
     // ── Helpers ────────────────────────────────────────────────────────────
     function displayError(el, msg) {
@@ -165,7 +176,7 @@ document.addEventListener('DOMContentLoaded', () => {
             return;
         }
         try {
-            const data = await makeApiRequest('/login', 'POST', { username, password }, false);
+            const data = await makeApiRequest('/login', 'POST', { username, password, device: deviceId }, false);
             if (data && typeof data === 'string') {
                 authToken       = data;
                 currentUsername = username;
@@ -218,7 +229,7 @@ document.addEventListener('DOMContentLoaded', () => {
         localStorage.removeItem('authToken');
         localStorage.removeItem('currentUsername');
 
-        if (webSocket) { webSocket.close(); webSocket = null; }
+        disconnect();
 
         chats         = {};
         messages      = {};
@@ -246,50 +257,157 @@ document.addEventListener('DOMContentLoaded', () => {
             '<p id="no-chat-selected" class="m-auto text-on-surface-variant text-sm text-center">Select a chat to start messaging.</p>';
     }
 
-    // ── WebSocket ──────────────────────────────────────────────────────────
+    // ── Connection ─────────────────────────────────────────────────────────
+    // Events come over a WebSocket, or over server-sent events when WebSockets are blocked by a proxy
+    let eventSource = null;
+    let sseClientId = null;
+    // Capabilities the server sent on connect, e.g. max_message_size
+    let serverHello = null;
+    let chunkCounter = 0;
+    let useEventSource = false;
+    let webSocketFailures = 0;
+
+    function isConnected() {
+        if (useEventSource) return !!(eventSource && sseClientId);
+        return !!(webSocket && webSocket.readyState === WebSocket.OPEN);
+    }
+
+    function sendFrame(event) {
+        if (!useEventSource) { webSocket.send(JSON.stringify(event)); return; }
+        makeApiRequest(`/send?client=${encodeURIComponent(sseClientId)}`, 'POST', event)
+            .catch(err => console.error('Send error:', err));
+    }
+
+    // Events larger than the server's frame limit are split into chunks the server reassembles
+    function sendEvent(event) {
+        const data = JSON.stringify(event);
+        const maxFrameSize = (serverHello && serverHello.max_frame_size) || DEFAULT_MAX_FRAME_SIZE;
+        if (new TextEncoder().encode(data).length <= maxFrameSize) { sendFrame(event); return; }
+
+        // Leave room for the chunk envelope, escaping and multi-byte characters
+        const step = Math.max(1, Math.floor((maxFrameSize - 128) / 3));
+        const id = `chunk-${++chunkCounter}`;
+        for (let start = 0, index = 0; start < data.length; index++) {
+            let end = Math.min(start + step, data.length);
+            // Don't split surrogate pairs
+            if (end < data.length && /[\uD800-\uDBFF]/.test(data[end - 1])) end--;
+            sendFrame({ v: 1, type: 'chunk', id, payload: { index, last: end === data.length, data: data.slice(start, end) } });
+            start = end;
+        }
+    }
+
+    function resumeQuery() {
+        const resume = Object.entries(lastSeq).map(([chatId, seq]) => `${chatId}:${seq}`).join(',');
+        return `resume=${encodeURIComponent(resume)}`;
+    }
+
+    function connect() {
+        if (useEventSource) connectEventSource(); else connectWebSocket();
+    }
+
+    function disconnect() {
+        if (webSocket) { webSocket.close(); webSocket = null; }
+        if (eventSource) { eventSource.close(); eventSource = null; sseClientId = null; }
+    }
+
+    function handleServerEvent(data) {
+        try {
+            const envelope = JSON.parse(data);
+            if (envelope.type === 'error') {
+                console.error('Server error event:', envelope.payload);
+                if (envelope.payload && envelope.payload.code === 'slow_down') {
+                    displayError(messageErrorP, 'You are sending messages too fast. Please wait a moment.');
+                }
+                return;
+            }
+            const msg = envelope.payload;
+            if (envelope.type === 'connected' && msg) { sseClientId = msg.client_id; return; }
+            if (envelope.type === 'hello' && msg) { serverHello = msg; return; }
+            if (envelope.type === 'ack' && msg) { noteSeq(msg); return; }
+            if (envelope.type === 'presence' && msg) { presence[msg.username] = msg; renderTypingIndicator(); return; }
+            if ((envelope.type === 'typing_start' || envelope.type === 'typing_stop') && msg) {
+                handleTyping(msg, envelope.type === 'typing_start');
+                return;
+            }
+            // Too many messages were missed, reload the chat from the history
+            if (envelope.type === 'resumed' && msg && msg.more) {
+                if (msg.chat_id === currentChatId) fetchAndRenderMessages(msg.chat_id);
+                return;
+            }
+            if (envelope.type === 'message' && msg && msg.id && isConnected()) {
+                // Acknowledge so the server doesn't redeliver the message on reconnect
+                sendEvent({ v: 1, type: 'ack', payload: { id: msg.id, chat_id: msg.chat_id } });
+            }
+            if (envelope.type === 'message' && msg && msg.from && msg.chat_id && msg.text) handleIncomingMessage(msg);
+        } catch (e) { console.error('Event parse error:', e); }
+    }
+
     function connectWebSocket() {
         if (webSocket && webSocket.readyState === WebSocket.OPEN) return;
         if (!authToken) { handleLogout(); return; }
 
-        const wsUrl = `${WS_BASE_URL}/ws`;
-        webSocket = new WebSocket(wsUrl);
+        const socket = new WebSocket(`${WS_BASE_URL}/ws?${resumeQuery()}`, [WS_SUBPROTOCOL]);
+        let opened = false;
+        webSocket = socket;
 
-        webSocket.onopen = () => console.log('WebSocket connected.');
+        socket.onopen = () => { opened = true; webSocketFailures = 0; console.log('WebSocket connected.'); };
 
-        webSocket.onmessage = (event) => {
-            try {
-                const msg = JSON.parse(event.data);
-                if (msg.from && msg.chat_id && msg.text) handleIncomingMessage(msg);
-            } catch (e) { console.error('WS parse error:', e); }
-        };
+        socket.onmessage = (event) => handleServerEvent(event.data);
 
-        webSocket.onerror = (err) => {
+        socket.onerror = (err) => {
             console.error('WebSocket error:', err);
             displayError(messageErrorP, 'WebSocket error. Real-time updates may fail.');
         };
 
-        webSocket.onclose = (event) => {
+        socket.onclose = (event) => {
             console.log('WebSocket closed:', event.code, event.reason);
-            webSocket = null;
+            if (webSocket === socket) webSocket = null;
+            if (!authToken) return;
+            // WebSockets that never open are likely blocked, fall back to server-sent events
+            if (!opened && ++webSocketFailures >= 2) {
+                useEventSource = true;
+                connect();
+                return;
+            }
+            displayError(messageErrorP, 'Disconnected. Reconnecting…');
+            setTimeout(connect, 5000);
+        };
+    }
+
+    function connectEventSource() {
+        if (eventSource) return;
+        if (!authToken) { handleLogout(); return; }
+
+        eventSource = new EventSource(`${API_BASE_URL}/events?${resumeQuery()}`);
+        eventSource.onopen = () => console.log('Event stream connected.');
+        eventSource.onmessage = (event) => handleServerEvent(event.data);
+        eventSource.onerror = () => {
+            // Reconnect ourselves so the resume positions are up to date
+            console.error('Event stream error.');
+            eventSource.close();
+            eventSource = null;
+            sseClientId = null;
             if (authToken) {
                 displayError(messageErrorP, 'Disconnected. Reconnecting…');
-                setTimeout(connectWebSocket, 5000);
+                setTimeout(connect, 5000);
             }
         };
     }
 
     function sendMessage(text) {
-        if (!webSocket || webSocket.readyState !== WebSocket.OPEN) {
+        if (!isConnected()) {
             displayError(messageErrorP, 'Not connected. Reconnecting…');
-            connectWebSocket();
+            connect();
             return;
         }
         if (!currentChatId) { displayError(messageErrorP, 'No active chat selected.'); return; }
         if (!text.trim()) return;
 
         const msg = { from: currentUsername, chat_id: currentChatId, text: text.trim() };
+        // Sending a message ends typing on the server
+        typingChatId = null;
         try {
-            webSocket.send(JSON.stringify(msg));
+            sendEvent({ v: 1, type: 'message', payload: msg });
             messageInput.value = '';
             messageInput.style.height = 'auto';
             clearError(messageErrorP);
@@ -302,13 +420,113 @@ document.addEventListener('DOMContentLoaded', () => {
     }
 
     function handleIncomingMessage(msg) {
+        // Messages may be delivered more than once
+        if (msg.id && (messages[msg.chat_id] || []).some(m => m.id === msg.id)) return;
+        noteSeq(msg);
         storeMessage(msg);
         if (msg.chat_id === currentChatId) {
             appendMessageToUI(msg, msg.from === currentUsername);
+            markRead(msg.chat_id);
+        } else if (chats[msg.chat_id] && msg.from !== currentUsername) {
+            chats[msg.chat_id].unread = (chats[msg.chat_id].unread || 0) + 1;
         }
         updateChatListPreview(msg.chat_id, msg.text);
     }
 
+    // ── Typing ─────────────────────────────────────────────────────────────
+    // Users typing per chat; the server sends typing_stop when a user stops or goes quiet
+    let typingUsers = {};
+    let lastTypingSent = 0;
+    let typingChatId = null;
+
+    function sendTyping(type, chatId) {
+        if (!chatId || !isConnected()) return;
+        sendEvent({ v: 1, type, payload: { chat_id: chatId } });
+    }
+
+    function handleLocalTyping() {
+        if (!currentChatId) return;
+        if (!messageInput.value.trim()) { stopLocalTyping(); return; }
+        // Repeat typing_start before the server-side expiry runs out
+        const now = Date.now();
+        if (typingChatId !== currentChatId || now - lastTypingSent > 3000) {
+            if (typingChatId && typingChatId !== currentChatId) stopLocalTyping();
+            sendTyping('typing_start', currentChatId);
+            typingChatId = currentChatId;
+            lastTypingSent = now;
+        }
+    }
+
+    function stopLocalTyping() {
+        if (!typingChatId) return;
+        sendTyping('typing_stop', typingChatId);
+        typingChatId = null;
+        lastTypingSent = 0;
+    }
+
+    function handleTyping(msg, started) {
+        if (msg.from === currentUsername) return;
+        const users = typingUsers[msg.chat_id] || (typingUsers[msg.chat_id] = new Set());
+        if (started) users.add(msg.from); else users.delete(msg.from);
+        renderTypingIndicator();
+    }
+
+    // ── Presence ───────────────────────────────────────────────────────────
+    let presence = {};
+
+    async function fetchPresence(username) {
+        try {
+            const fetched = await makeApiRequest(`/presence?users=${encodeURIComponent(username)}`);
+            if (Array.isArray(fetched)) fetched.forEach(p => { presence[p.username] = p; });
+            renderTypingIndicator();
+        } catch (error) {
+            console.error('Error fetching presence:', error);
+        }
+    }
+
+    function presenceText(username) {
+        const p = presence[username];
+        if (!p) return '';
+        if (p.online) return 'online';
+        return p.last_seen ? `last seen ${new Date(p.last_seen * 1000).toLocaleString()}` : '';
+    }
+
+    // Shows who is typing in the current chat, or presence of the other member of a direct chat
+    function renderTypingIndicator() {
+        const users = currentChatId && typingUsers[currentChatId] ? [...typingUsers[currentChatId]] : [];
+        if (users.length === 0) {
+            const chat = chats[currentChatId];
+            const status = chat && chat.members.length === 2 ? presenceText(chat.otherUser) : '';
+            typingIndicatorP.textContent = status;
+            typingIndicatorP.style.display = status ? '' : 'none';
+            return;
+        }
+        typingIndicatorP.textContent = users.length === 1 ? `${users[0]} is typing…` : `${users.join(', ')} are typing…`;
+        typingIndicatorP.style.display = '';
+    }
+
+    function markRead(chatId) {
+        if (chats[chatId]) chats[chatId].unread = 0;
+        updateUnreadBadge(chatId);
+        if (!lastSeq[chatId] || !isConnected()) return;
+        sendEvent({ v: 1, type: 'read', payload: { chat_id: chatId, seq: lastSeq[chatId] } });
+    }
+
+    function unreadBadgeHtml(chat) {
+        return chat && chat.unread > 0
+            ? `<span class="unread-badge min-w-6 h-6 px-2 rounded-full bg-primary text-on-primary text-xs font-bold flex items-center justify-center shrink-0">${chat.unread}</span>`
+            : '';
+    }
+
+    function updateUnreadBadge(chatId) {
+        const li = chatListUl.querySelector(`li[data-chat-id="${chatId}"]`);
+        if (!li) return;
+        const old = li.querySelector('.unread-badge');
+        if (old) old.remove();
+        const html = unreadBadgeHtml(chats[chatId]);
+        if (html) li.insertAdjacentHTML('beforeend', html);
+    }
+
     // ── Chats ──────────────────────────────────────────────────────────────
     async function fetchChats() {
         if (!currentUsername) return;
@@ -369,6 +587,7 @@ document.addEventListener('DOMContentLoaded', () => {
                     <h3 class="font-headline font-bold text-lg text-primary truncate mb-1">${displayName}</h3>
                     <p class="${previewCls}">${preview}</p>
                 </div>
+                ${unreadBadgeHtml(chat)}
             `;
 
             li.addEventListener('click', () => selectChat(chat.id));
@@ -379,7 +598,9 @@ document.addEventListener('DOMContentLoaded', () => {
     async function selectChat(chatId) {
         if (currentChatId === chatId) { showChatView(); return; }
 
+        stopLocalTyping();
         currentChatId = chatId;
+        renderTypingIndicator();
         resetMessagesContainer();
         clearError(messageErrorP);
 
@@ -397,7 +618,9 @@ document.addEventListener('DOMContentLoaded', () => {
         currentChatNameH2.textContent = displayName;
 
         showChatView();
+        if (chat && chat.members.length === 2) fetchPresence(chat.otherUser);
         await fetchAndRenderMessages(chatId);
+        markRead(chatId);
     }
 
     function storeMessage(msg) {
@@ -408,6 +631,10 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
+    function noteSeq(msg) {
+        if (msg.chat_id && msg.seq && !(lastSeq[msg.chat_id] >= msg.seq)) lastSeq[msg.chat_id] = msg.seq;
+    }
+
     async function fetchAndRenderMessages(chatId) {
         messagesContainer.innerHTML = '<p class="m-auto text-on-surface-variant text-sm">Loading…</p>';
         try {
@@ -417,7 +644,8 @@ document.addEventListener('DOMContentLoaded', () => {
 
             if (Array.isArray(fetched) && fetched.length > 0) {
                 fetched.forEach(msg => {
-                    storeMessage({ from: msg.from, text: msg.text, chat_id: msg.chat_id });
+                    noteSeq(msg);
+                    storeMessage({ id: msg.id, from: msg.from, text: msg.text, chat_id: msg.chat_id });
                     appendMessageToUI({ from: msg.from, text: msg.text, chat_id: msg.chat_id }, msg.from === currentUsername);
                 });
                 // Seed the preview with the real last message from the server
@@ -469,6 +697,7 @@ document.addEventListener('DOMContentLoaded', () => {
             }
             chatListUl.prepend(li);
         }
+        updateUnreadBadge(chatId);
     }
 
     function scrollToBottom(el) { el.scrollTop = el.scrollHeight; }
@@ -543,7 +772,7 @@ document.addEventListener('DOMContentLoaded', () => {
         currentChatNameH2.textContent = '';
 
         fetchChats();
-        connectWebSocket();
+        connect();
     }
 
     // ── Focus search and go to chats list ─────────────────────────────────
@@ -590,7 +819,9 @@ document.addEventListener('DOMContentLoaded', () => {
     messageInput.addEventListener('input', () => {
         messageInput.style.height = 'auto';
         messageInput.style.height = Math.min(messageInput.scrollHeight, 128) + 'px';
+        handleLocalTyping();
     });
+    messageInput.addEventListener('blur', stopLocalTyping);
 
     // Send on Enter (Shift+Enter for newline)
     messageInput.addEventListener('keydown', (e) => {
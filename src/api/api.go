@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,13 +26,34 @@ const minPasswordLength = 8
 type authRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	//Device identifies the client's device on login, a new one is generated if it's empty
+	Device string `json:"device,omitempty"`
 }
 
+type editRequest struct {
+	Text string `json:"text"`
+}
+
+type readRequest struct {
+	Seq int64 `json:"seq"`
+}
+
+// maxPresenceUsers is the maximum number of users whose presence can be requested at once
+const maxPresenceUsers = 100
+
+// defaultPollTimeout and maxPollTimeout limit how long long-poll requests wait for events
+const (
+	defaultPollTimeout = time.Second * 25
+	maxPollTimeout     = time.Second * 55
+)
+
 type Server struct {
 	manager      *ws.Manager
 	logger       *zap.SugaredLogger
 	tokenManager token.Manager
 	store        store.Storer
+	//Admins lists usernames allowed to read server metrics, nobody can read them if it's empty
+	Admins []string
 }
 
 // New creates new server
@@ -53,6 +78,12 @@ func (s *Server) Run(ctx context.Context, addr string) error {
 	http.Handle("/", http.FileServer(http.Dir("./frontend")))
 	//Serves websocket connections
 	http.HandleFunc("/ws", s.authorize(s.serveWS))
+	//Streams events as server-sent events for clients that can't use websockets
+	http.HandleFunc("/events", s.authorize(s.handleEvents))
+	//Handles events sent by server-sent events clients
+	http.HandleFunc("/send", s.authorize(s.handleSend))
+	//Returns queued events to long-poll clients that can't keep a connection open
+	http.HandleFunc("/poll", s.authorize(s.handlePoll))
 	//handles registering logic
 	http.HandleFunc("/register", s.handleRegister)
 	//handles login logic
@@ -67,6 +98,22 @@ func (s *Server) Run(ctx context.Context, addr string) error {
 	http.HandleFunc("/newChat", s.authorize(s.handleNewChat))
 	//Removes user from chat. User can only remove others if they are owner of the chat
 	http.HandleFunc("/remove/{chatId}/{username}", s.authorize(s.handleRemove))
+	//Edits a message. Only the author can edit their messages
+	http.HandleFunc("/edit/{chatId}/{messageId}", s.authorize(s.handleEdit))
+	//Deletes a message for everyone. Authors can delete their messages and owners can delete any message in their chat
+	http.HandleFunc("/delete/{chatId}/{messageId}", s.authorize(s.handleDelete))
+	//Deletes a message only for the user
+	http.HandleFunc("/hide/{chatId}/{messageId}", s.authorize(s.handleHide))
+	//Writes previous versions of an edited message as a response
+	http.HandleFunc("/revisions/{chatId}/{messageId}", s.authorize(s.handleRevisions))
+	//Writes last read positions of chat members on GET and marks messages as read on POST
+	http.HandleFunc("/read/{chatId}", s.authorize(s.handleRead))
+	//Writes presence of users listed in the comma separated users query parameter
+	http.HandleFunc("/presence", s.authorize(s.handlePresence))
+	//Writes delivery state of the user's devices
+	http.HandleFunc("/devices", s.authorize(s.handleDevices))
+	//Writes websocket fan-out metrics to admins
+	http.HandleFunc("/metrics", s.authorize(s.handleMetrics))
 
 	//Run the server
 	ch := make(chan error)
@@ -99,6 +146,13 @@ func (s *Server) Run(ctx context.Context, addr string) error {
 
 // serveWS upgrades http request to a websocket connection
 func (s *Server) serveWS(w http.ResponseWriter, r *http.Request) {
+	//Parse last seen sequence numbers of the chats sent by reconnecting clients
+	lastSeq, err := ws.ParseResume(r.URL.Query().Get("resume"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	//Upgrade connection
 	conn, err := s.manager.WSUpgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -106,9 +160,9 @@ func (s *Server) serveWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//Create a new client
+	//Create a new client. Device id lets the client get messages it hasn't acknowledged after a reconnect
 	username := r.Context().Value("username")
-	client := ws.NewClient(conn, s.manager, username.(string))
+	client := ws.NewClient(conn, s.manager, username.(string), requestDevice(r))
 
 	//Add client to client list
 	if err := s.manager.AddClient(r.Context(), client); err != nil {
@@ -116,11 +170,163 @@ func (s *Server) serveWS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error adding client", http.StatusInternalServerError)
 	}
 
+	//Replay messages sent while the client was offline before live traffic
+	if err := s.manager.Resume(r.Context(), client, lastSeq); err != nil {
+		s.logger.Errorw("Error resuming client", "error", err)
+	}
+
 	//Start read/write processes in separate goroutines
 	go client.ReadMessages(r.Context())
 	go client.WriteMessages(r.Context())
 }
 
+// handleEvents streams events to the client as server-sent events. It's a fallback for networks where websockets
+// don't work, the client gets the same events and sends its events to /send
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	//Parse last seen sequence numbers of the chats sent by reconnecting clients
+	lastSeq, err := ws.ParseResume(r.URL.Query().Get("resume"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//Create a new client
+	username := r.Context().Value("username")
+	client, err := ws.NewSSEClient(w, s.manager, username.(string), requestDevice(r))
+	if err != nil {
+		s.logger.Errorw("Error creating client", "error", err)
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	//Add client to client list
+	if err := s.manager.AddClient(r.Context(), client); err != nil {
+		s.logger.Errorw("Error adding client", "error", err)
+		http.Error(w, "Error adding client", http.StatusInternalServerError)
+		return
+	}
+
+	//Replay messages sent while the client was offline before live traffic
+	if err := s.manager.Resume(r.Context(), client, lastSeq); err != nil {
+		s.logger.Errorw("Error resuming client", "error", err)
+	}
+
+	//Write events until the client disconnects
+	client.ServeEvents(r.Context())
+}
+
+// handleSend handles an event sent by a server-sent events or long-poll client. The client id from the connected event
+// is passed in the client query parameter, replies are sent the same way as other events
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	//Read the event, larger events must be sent in chunks like over websocket
+	limit := s.manager.MaxFrameSize
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+	if err != nil {
+		http.Error(w, (&ws.TooLargeError{Limit: limit}).Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	//Handle the event
+	username := r.Context().Value("username")
+	if err := s.manager.ReceiveEvent(r.Context(), username.(string), r.URL.Query().Get("client"), data); err != nil {
+		if errors.Is(err, ws.ErrClientNotFound) {
+			http.Error(w, "Client not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlePoll returns events queued for a long-poll client as a json array. Without the client query parameter
+// a new client is created and its queued events are returned at once, the first of them carries the client id.
+// With it the request waits for events until the timeout query parameter in seconds elapses
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value("username").(string)
+
+	var client *ws.Client
+	timeout := defaultPollTimeout
+	if clientId := r.URL.Query().Get("client"); clientId != "" {
+		//Get the client
+		var err error
+		client, err = s.manager.Client(username, clientId)
+		if err != nil {
+			http.Error(w, "Client not found", http.StatusNotFound)
+			return
+		}
+
+		//Parse the timeout
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				http.Error(w, "Invalid timeout", http.StatusBadRequest)
+				return
+			}
+			timeout = min(time.Duration(seconds)*time.Second, maxPollTimeout)
+		}
+	} else {
+		//Parse last seen sequence numbers of the chats sent by reconnecting clients
+		lastSeq, err := ws.ParseResume(r.URL.Query().Get("resume"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		//Create a new client and add it to the client list
+		client, err = ws.NewPollClient(s.manager, username, requestDevice(r))
+		if err != nil {
+			s.logger.Errorw("Error creating client", "error", err)
+			http.Error(w, "Error creating client", http.StatusInternalServerError)
+			return
+		}
+		if err := s.manager.AddClient(r.Context(), client); err != nil {
+			s.logger.Errorw("Error adding client", "error", err)
+			http.Error(w, "Error adding client", http.StatusInternalServerError)
+			return
+		}
+
+		//Replay messages sent while the client was offline
+		if err := s.manager.Resume(r.Context(), client, lastSeq); err != nil {
+			s.logger.Errorw("Error resuming client", "error", err)
+		}
+		timeout = 0
+	}
+
+	//Wait for events
+	events, err := client.Poll(r.Context(), timeout)
+	if err != nil {
+		switch {
+		case errors.Is(err, ws.ErrPollInProgress):
+			http.Error(w, "Poll in progress", http.StatusConflict)
+		default:
+			http.Error(w, "Client not found", http.StatusNotFound)
+		}
+		return
+	}
+	if events == nil {
+		events = []ws.Event{}
+	}
+
+	//Write events
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		s.logger.Errorw("Error encoding json", "error", err)
+	}
+}
+
+// requestDevice returns device of the authorized user. It's only taken from the token,
+// so clients can't make the server keep state for arbitrary devices
+func requestDevice(r *http.Request) string {
+	device, _ := r.Context().Value("device").(string)
+	return device
+}
+
 // handleRegister registers user using username and password
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	//Get user data from request
@@ -179,8 +385,12 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//Create access token
-	accessToken, err := s.tokenManager.NewToken(body.Username)
+	//Create access token for the device
+	device := body.Device
+	if device == "" {
+		device = primitive.NewObjectID().Hex()
+	}
+	accessToken, err := s.tokenManager.NewToken(body.Username, device)
 	if err != nil {
 		s.logger.Errorw("Error creating JWT token:", "error", err)
 		http.Error(w, "Error creating JWT token", http.StatusInternalServerError)
@@ -241,8 +451,9 @@ func (s *Server) authorize(fn func(w http.ResponseWriter, r *http.Request)) func
 			return
 		}
 
-		//Pass username of the user as a context value
-		r = r.WithContext(context.WithValue(r.Context(), "username", claims.Subject))
+		//Pass username and device of the user as context values
+		ctx := context.WithValue(r.Context(), "username", claims.Subject)
+		r = r.WithContext(context.WithValue(ctx, "device", claims.Device))
 		fn(w, r)
 	}
 }
@@ -289,8 +500,8 @@ func (s *Server) handleChats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//Get chat from the database
-	chats, err := s.store.GetChats(r.Context(), username)
+	//Get chats with unread message counts
+	chats, err := s.manager.Chats(r.Context(), username)
 	if err != nil {
 		s.logger.Errorw("Error getting chats", "error", err)
 		http.Error(w, "Error getting chats", http.StatusInternalServerError)
@@ -312,32 +523,39 @@ func (s *Server) handleChats(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleMessages writes messages from a specific chat as a response
+// handleMessages writes messages from a specific chat as a response.
+// If before, after or limit query parameters are set a page of messages sorted newest first is written,
+// otherwise the whole chat history is written
 func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 	//get chatId from the query
 	chatId := r.PathValue("chatId")
-
-	//Get chat data from the database
-	chat, err := s.store.GetChat(r.Context(), chatId)
-	if err != nil {
-		s.logger.Errorw("Error getting chat from the database", "error", err)
-		http.Error(w, "Error getting chat from the database", http.StatusInternalServerError)
-	}
-
-	//Check if user is a member of the chat
-	present := false
-	for _, v := range chat.Members {
-		if v == r.Context().Value("username") {
-			present = true
+	username := r.Context().Value("username").(string)
+
+	//Get messages the user hasn't hidden from the database
+	var messages interface{}
+	var err error
+	query := r.URL.Query()
+	if query.Has("before") || query.Has("after") || query.Has("limit") {
+		var page *store.MessagePage
+		if page, err = s.messagesPage(r.Context(), username, chatId, query); err == nil {
+			messages = page
 		}
+	} else {
+		messages, err = s.manager.History(r.Context(), username, chatId)
+	}
+	var numErr *strconv.NumError
+	if errors.Is(err, store.ErrInvalidCursor) || errors.As(err, &numErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if !present {
+	if errors.Is(err, ws.ErrForbidden) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-
-	//Get messages from the database
-	messages, err := s.store.GetMessages(r.Context(), chatId)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		s.logger.Errorw("Error getting messages from the database", "error", err)
 		http.Error(w, "Error getting messages from the database", http.StatusInternalServerError)
@@ -359,6 +577,25 @@ func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// messagesPage gets a page of messages using before, after and limit query parameters
+func (s *Server) messagesPage(ctx context.Context, username, chatId string, query url.Values) (*store.MessagePage, error) {
+	//Parse limit
+	limit := 0
+	if query.Has("limit") {
+		var err error
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil {
+			return nil, err
+		}
+	}
+
+	//Get page from the database
+	return s.manager.HistoryPage(ctx, username, chatId, store.MessageQuery{
+		Before: query.Get("before"),
+		After:  query.Get("after"),
+		Limit:  limit,
+	})
+}
+
 // handleNewChat receives a chat object and creates new chat and writes chat id as a response
 func (s *Server) handleNewChat(w http.ResponseWriter, r *http.Request) {
 	//Decode request
@@ -375,19 +612,14 @@ func (s *Server) handleNewChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//Create new chat
-	id, err := s.store.NewChat(r.Context(), body.Members, body.Owner)
+	//Create new chat, connected clients of its members receive messages immediately
+	id, err := s.manager.CreateChat(r.Context(), body.Owner, body.Members)
 	if err != nil {
 		s.logger.Errorw("Error creating chat", "error", err)
 		http.Error(w, "Error creating chat", http.StatusInternalServerError)
 		return
 	}
 
-	//Register new chat in the WS manager so connected clients receive messages immediately
-	if oid, ok := id.(primitive.ObjectID); ok {
-		s.manager.AddChatClients(oid.Hex(), body.Members)
-	}
-
 	//Set header
 	w.Header().Set("Content-Type", "application/json")
 
@@ -430,5 +662,298 @@ func (s *Server) handleRemove(w http.ResponseWriter, r *http.Request) {
 	if err := s.store.RemoveUserFromChat(r.Context(), r.PathValue("username"), chatId); err != nil {
 		s.logger.Errorw("Error leaving chat", "error", err)
 		http.Error(w, "Error leaving chat", http.StatusInternalServerError)
+		return
+	}
+
+	//Stop routing chat messages to the removed user
+	s.manager.RemoveChatMember(chatId, r.PathValue("username"))
+}
+
+// handleEdit replaces text of a message and writes the edited message as a response
+func (s *Server) handleEdit(w http.ResponseWriter, r *http.Request) {
+	//Decode request
+	var body editRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.logger.Errorw("Error decoding json", "error", err)
+		http.Error(w, "Error decoding json", http.StatusInternalServerError)
+		return
+	}
+
+	//Edit message and notify connected chat members
+	msg, err := s.manager.EditMessage(r.Context(), r.Context().Value("username").(string), r.PathValue("chatId"), r.PathValue("messageId"), body.Text)
+	if errors.Is(err, ws.ErrForbidden) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("Error editing message", "error", err)
+		http.Error(w, "Error editing message", http.StatusInternalServerError)
+		return
+	}
+
+	//Marshal response
+	response, err := json.Marshal(msg)
+	if err != nil {
+		s.logger.Errorw("Error marshaling json", "error", err)
+		http.Error(w, "Error marshaling json", http.StatusInternalServerError)
+		return
+	}
+
+	//Write response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response); err != nil {
+		s.logger.Errorw("Error writing a response", "error", err)
+	}
+}
+
+// handleDelete deletes a message for everyone and writes the message tombstone as a response
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	//Delete message and notify connected chat members
+	msg, err := s.manager.DeleteMessage(r.Context(), r.Context().Value("username").(string), r.PathValue("chatId"), r.PathValue("messageId"))
+	if errors.Is(err, ws.ErrForbidden) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("Error deleting message", "error", err)
+		http.Error(w, "Error deleting message", http.StatusInternalServerError)
+		return
+	}
+
+	//Marshal response
+	response, err := json.Marshal(msg)
+	if err != nil {
+		s.logger.Errorw("Error marshaling json", "error", err)
+		http.Error(w, "Error marshaling json", http.StatusInternalServerError)
+		return
+	}
+
+	//Write response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response); err != nil {
+		s.logger.Errorw("Error writing a response", "error", err)
+	}
+}
+
+// handleHide deletes a message only for the user
+func (s *Server) handleHide(w http.ResponseWriter, r *http.Request) {
+	err := s.manager.HideMessage(r.Context(), r.Context().Value("username").(string), r.PathValue("chatId"), r.PathValue("messageId"))
+	if errors.Is(err, ws.ErrForbidden) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("Error hiding message", "error", err)
+		http.Error(w, "Error hiding message", http.StatusInternalServerError)
+	}
+}
+
+// handleRevisions writes previous versions of a message as a response
+func (s *Server) handleRevisions(w http.ResponseWriter, r *http.Request) {
+	chatId := r.PathValue("chatId")
+
+	//Get chat data from the database
+	chat, err := s.store.GetChat(r.Context(), chatId)
+	if err != nil {
+		s.logger.Errorw("Error getting chat from the database", "error", err)
+		http.Error(w, "Error getting chat from the database", http.StatusInternalServerError)
+		return
+	}
+
+	//Check if user is a member of the chat
+	if !slices.Contains(chat.Members, r.Context().Value("username").(string)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	//Get revisions from the database
+	revisions, err := s.store.GetRevisions(r.Context(), chatId, r.PathValue("messageId"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("Error getting revisions from the database", "error", err)
+		http.Error(w, "Error getting revisions from the database", http.StatusInternalServerError)
+		return
+	}
+
+	//Marshal response
+	response, err := json.Marshal(revisions)
+	if err != nil {
+		s.logger.Errorw("Error marshaling json", "error", err)
+		http.Error(w, "Error marshaling json", http.StatusInternalServerError)
+		return
+	}
+
+	//Write response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response); err != nil {
+		s.logger.Errorw("Error writing a response", "error", err)
+	}
+}
+
+// handleRead writes last read positions of chat members by username on GET requests.
+// On POST requests marks messages up to the sequence number as read and writes the read receipt
+func (s *Server) handleRead(w http.ResponseWriter, r *http.Request) {
+	chatId := r.PathValue("chatId")
+	username := r.Context().Value("username").(string)
+
+	var result any
+	if r.Method == http.MethodPost {
+		//Decode request
+		var body readRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Seq < 0 {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		//Mark messages as read and notify connected chat members
+		read, err := s.manager.MarkRead(r.Context(), username, chatId, body.Seq, nil)
+		if errors.Is(err, ws.ErrForbidden) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.logger.Errorw("Error marking messages as read", "error", err)
+			http.Error(w, "Error marking messages as read", http.StatusInternalServerError)
+			return
+		}
+		result = read
+	} else {
+		//Get chat data from the database
+		chat, err := s.store.GetChat(r.Context(), chatId)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.logger.Errorw("Error getting chat from the database", "error", err)
+			http.Error(w, "Error getting chat from the database", http.StatusInternalServerError)
+			return
+		}
+
+		//Check if user is a member of the chat
+		if !slices.Contains(chat.Members, username) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		//Get read positions from the database
+		state, err := s.store.GetReadState(r.Context(), chatId)
+		if err != nil {
+			s.logger.Errorw("Error getting read state from the database", "error", err)
+			http.Error(w, "Error getting read state from the database", http.StatusInternalServerError)
+			return
+		}
+		result = state
+	}
+
+	//Marshal response
+	response, err := json.Marshal(result)
+	if err != nil {
+		s.logger.Errorw("Error marshaling json", "error", err)
+		http.Error(w, "Error marshaling json", http.StatusInternalServerError)
+		return
+	}
+
+	//Write response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response); err != nil {
+		s.logger.Errorw("Error writing a response", "error", err)
+	}
+}
+
+// handlePresence writes online status and last seen time of the requested users as a response.
+// Users who share no chat with the requester are reported as unknown
+func (s *Server) handlePresence(w http.ResponseWriter, r *http.Request) {
+	//Get usernames from the query
+	var usernames []string
+	for _, username := range strings.Split(r.URL.Query().Get("users"), ",") {
+		if username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+	if len(usernames) == 0 || len(usernames) > maxPresenceUsers {
+		http.Error(w, "Between 1 and "+strconv.Itoa(maxPresenceUsers)+" users must be requested", http.StatusBadRequest)
+		return
+	}
+
+	//Get presence of the users, users who don't share a chat with the requester are hidden
+	presence, err := s.manager.Presence(r.Context(), r.Context().Value("username").(string), usernames)
+	if err != nil {
+		s.logger.Errorw("Error getting presence", "error", err)
+		http.Error(w, "Error getting presence", http.StatusInternalServerError)
+		return
+	}
+
+	//Marshal response
+	response, err := json.Marshal(presence)
+	if err != nil {
+		s.logger.Errorw("Error marshaling json", "error", err)
+		http.Error(w, "Error marshaling json", http.StatusInternalServerError)
+		return
+	}
+
+	//Write response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response); err != nil {
+		s.logger.Errorw("Error writing a response", "error", err)
+	}
+}
+
+// handleDevices writes delivery state of the user's devices as a response
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	//Marshal response
+	response, err := json.Marshal(s.manager.Devices(r.Context().Value("username").(string)))
+	if err != nil {
+		s.logger.Errorw("Error marshaling json", "error", err)
+		http.Error(w, "Error marshaling json", http.StatusInternalServerError)
+		return
+	}
+
+	//Write response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response); err != nil {
+		s.logger.Errorw("Error writing a response", "error", err)
+	}
+}
+
+// handleMetrics writes counters of events sent to websocket clients as a response. Only admins can read them
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	//Check that user is an admin
+	if !slices.Contains(s.Admins, r.Context().Value("username").(string)) {
+		http.Error(w, "Metrics are available to admins only", http.StatusForbidden)
+		return
+	}
+
+	//Marshal response
+	response, err := json.Marshal(s.manager.Metrics())
+	if err != nil {
+		s.logger.Errorw("Error marshaling json", "error", err)
+		http.Error(w, "Error marshaling json", http.StatusInternalServerError)
+		return
+	}
+
+	//Write response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response); err != nil {
+		s.logger.Errorw("Error writing a response", "error", err)
 	}
 }
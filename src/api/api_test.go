@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -28,8 +29,11 @@ func TestServeWS(t *testing.T) {
 	s, err := createTestService()
 	assert.NoError(t, err)
 
-	//Create test server
-	srv := httptest.NewServer(http.HandlerFunc(s.serveWS))
+	//Create test server putting username in context so user is authorized
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveWS(w, r.WithContext(context.WithValue(r.Context(), "username", testUser.Username)))
+	}))
+	defer srv.Close()
 
 	//Convert http:// to ws://
 	u := "ws" + strings.TrimPrefix(srv.URL, "http")
@@ -37,7 +41,142 @@ func TestServeWS(t *testing.T) {
 	// Connect to the server
 	wsConn, _, err := websocket.DefaultDialer.Dial(u, nil)
 	assert.NoError(t, err)
+	assert.Equal(t, "", wsConn.Subprotocol())
 	assert.NoError(t, wsConn.Close())
+
+	//Connect with the versioned protocol and check that server sends its capabilities
+	dialer := websocket.Dialer{Subprotocols: []string{"messenger.v2.json", ws.SubprotocolJSON}}
+	wsConn, _, err = dialer.Dial(u, nil)
+	assert.NoError(t, err)
+	defer wsConn.Close()
+	assert.Equal(t, ws.SubprotocolJSON, wsConn.Subprotocol())
+	var event ws.Event
+	assert.NoError(t, wsConn.ReadJSON(&event))
+	assert.Equal(t, ws.EventHello, event.Type)
+	var hello ws.Hello
+	assert.NoError(t, json.Unmarshal(event.Payload, &hello))
+	assert.Equal(t, ws.ProtocolVersion, hello.Version)
+	assert.Equal(t, ws.DefaultMaxFrameSize, hello.MaxFrameSize)
+	assert.Equal(t, ws.DefaultMaxMessageSize, hello.MaxMessageSize)
+	assert.Contains(t, hello.Events, ws.EventMessage)
+}
+
+func TestHandleEvents(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//Create test server putting username in context so user is authorized
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), "username", testUser.Username))
+		switch r.URL.Path {
+		case "/events":
+			s.handleEvents(w, r)
+		case "/send":
+			s.handleSend(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	//Connect to the event stream
+	res, err := http.Get(srv.URL + "/events")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	events := bufio.NewReader(res.Body)
+
+	//Check that the first event carries the client id
+	event := readSSEEvent(t, events)
+	assert.Equal(t, ws.EventConnected, event.Type)
+	var connected ws.Connected
+	assert.NoError(t, json.Unmarshal(event.Payload, &connected))
+	assert.NotEmpty(t, connected.ClientId)
+	assert.Equal(t, ws.EventHello, readSSEEvent(t, events).Type)
+
+	//Send message and check that the ack is written to the stream
+	send, err := http.Post(srv.URL+"/send?client="+connected.ClientId, "application/json", strings.NewReader(`{"v":1,"type":"message","id":"1","payload":{"chat_id":"1","text":"hello"}}`))
+	assert.NoError(t, err)
+	assert.NoError(t, send.Body.Close())
+	assert.Equal(t, http.StatusAccepted, send.StatusCode)
+	event = readSSEEvent(t, events)
+	assert.Equal(t, ws.EventAck, event.Type)
+	assert.Equal(t, "1", event.Id)
+
+	//Check that unknown clients and malformed events are refused
+	send, err = http.Post(srv.URL+"/send?client=unknown", "application/json", strings.NewReader(`{}`))
+	assert.NoError(t, err)
+	assert.NoError(t, send.Body.Close())
+	assert.Equal(t, http.StatusNotFound, send.StatusCode)
+	send, err = http.Post(srv.URL+"/send?client="+connected.ClientId, "application/json", strings.NewReader(`not json`))
+	assert.NoError(t, err)
+	assert.NoError(t, send.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, send.StatusCode)
+}
+
+func TestHandlePoll(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//poll makes a poll request with the query and decodes returned events
+	poll := func(query string) ([]ws.Event, int) {
+		r := httptest.NewRequest(http.MethodGet, "/poll"+query, nil)
+		r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+		w := httptest.NewRecorder()
+		s.handlePoll(w, r)
+		var events []ws.Event
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&events))
+		}
+		return events, w.Code
+	}
+
+	//Check that the first poll creates a client and returns its id and server capabilities at once
+	events, code := poll("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, events, 2)
+	assert.Equal(t, ws.EventConnected, events[0].Type)
+	assert.Equal(t, ws.EventHello, events[1].Type)
+	var connected ws.Connected
+	assert.NoError(t, json.Unmarshal(events[0].Payload, &connected))
+
+	//Send message and check that the ack is returned by the next poll
+	r := httptest.NewRequest(http.MethodPost, "/send?client="+connected.ClientId, strings.NewReader(`{"v":1,"type":"message","id":"1","payload":{"chat_id":"1","text":"hello"}}`))
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handleSend(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	events, code = poll("?timeout=1&client=" + connected.ClientId)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, events, 1)
+	assert.Equal(t, ws.EventAck, events[0].Type)
+
+	//Check that poll returns an empty list after the timeout
+	events, code = poll("?timeout=0&client=" + connected.ClientId)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, events)
+
+	//Check that invalid timeouts and unknown clients are refused
+	_, code = poll("?timeout=-1&client=" + connected.ClientId)
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, code = poll("?client=unknown")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// readSSEEvent reads the next event from a server-sent events stream skipping comments
+func readSSEEvent(t *testing.T, r *bufio.Reader) ws.Event {
+	for {
+		line, err := r.ReadString('\n')
+		assert.NoError(t, err)
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event ws.Event
+			assert.NoError(t, json.Unmarshal([]byte(data), &event))
+			return event
+		}
+		if err != nil {
+			return ws.Event{}
+		}
+	}
 }
 
 func TestRegister(t *testing.T) {
@@ -128,12 +267,13 @@ func TestHandleChats(t *testing.T) {
 	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
 
 	//Decode json response
-	var chats []store.Chat
+	var chats []ws.ChatSummary
 	assert.NotNil(t, res.Body)
 	assert.NoError(t, json.NewDecoder(res.Body).Decode(&chats))
 
 	//Check that we got a correct response
 	assert.Equal(t, testUser.Username, chats[0].Owner)
+	assert.Equal(t, int64(0), chats[0].Unread)
 }
 
 func TestHandleMessages(t *testing.T) {
@@ -165,6 +305,41 @@ func TestHandleMessages(t *testing.T) {
 	assert.Equal(t, "hello world", msgs[0].Text)
 }
 
+func TestHandleMessagesPage(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//Make test request
+	r := httptest.NewRequest(http.MethodGet, "/messages?limit=10", nil)
+	r.SetPathValue("chatId", "1")
+
+	//Put username in context so user is authorized
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handleMessages(w, r)
+	res := w.Result()
+	defer assert.NoError(t, res.Body.Close())
+
+	//Check that status code is OK
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
+
+	//Decode json response
+	var page store.MessagePage
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+
+	//Check that we got a correct response
+	assert.Equal(t, "hello world", page.Messages[0].Text)
+
+	//Check that invalid limit is refused
+	r = httptest.NewRequest(http.MethodGet, "/messages?limit=ten", nil)
+	r.SetPathValue("chatId", "1")
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w = httptest.NewRecorder()
+	s.handleMessages(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
 func TestHandleNewChat(t *testing.T) {
 	//Create server
 	s, err := createTestService()
@@ -218,6 +393,261 @@ func TestHandleRemove(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestHandleEdit(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//Create request body
+	body, err := json.Marshal(editRequest{Text: "hello there"})
+	assert.NoError(t, err)
+
+	//Make test request
+	r := httptest.NewRequest(http.MethodPost, "/edit", bytes.NewBuffer(body))
+	r.SetPathValue("chatId", "1")
+	r.SetPathValue("messageId", "1")
+
+	//Put username in context so user is authorized
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handleEdit(w, r)
+	res := w.Result()
+	defer assert.NoError(t, res.Body.Close())
+
+	//Check that status code is OK
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
+
+	//Decode json response
+	var msg store.Message
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&msg))
+
+	//Check that we got a correct response
+	assert.Equal(t, "hello there", msg.Text)
+	assert.NotZero(t, msg.EditedAt)
+
+	//Check that other users can't edit the message
+	r = httptest.NewRequest(http.MethodPost, "/edit", bytes.NewBuffer(body))
+	r.SetPathValue("chatId", "1")
+	r.SetPathValue("messageId", "1")
+	r = r.WithContext(context.WithValue(context.Background(), "username", "otherUser"))
+	w = httptest.NewRecorder()
+	s.handleEdit(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
+
+func TestHandleDelete(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//Make test request
+	r := httptest.NewRequest(http.MethodPost, "/delete", nil)
+	r.SetPathValue("chatId", "1")
+	r.SetPathValue("messageId", "1")
+
+	//Put username in context so user is authorized
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handleDelete(w, r)
+	res := w.Result()
+	defer assert.NoError(t, res.Body.Close())
+
+	//Check that status code is OK
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
+
+	//Decode json response
+	var msg store.Message
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&msg))
+
+	//Check that we got a tombstone
+	assert.NotZero(t, msg.DeletedAt)
+	assert.Empty(t, msg.Text)
+
+	//Check that other users can't delete the message
+	r = httptest.NewRequest(http.MethodPost, "/delete", nil)
+	r.SetPathValue("chatId", "1")
+	r.SetPathValue("messageId", "1")
+	r = r.WithContext(context.WithValue(context.Background(), "username", "otherUser"))
+	w = httptest.NewRecorder()
+	s.handleDelete(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
+
+func TestHandleHide(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//Make test request
+	r := httptest.NewRequest(http.MethodPost, "/hide", nil)
+	r.SetPathValue("chatId", "1")
+	r.SetPathValue("messageId", "1")
+
+	//Put username in context so user is authorized
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handleHide(w, r)
+	res := w.Result()
+	defer assert.NoError(t, res.Body.Close())
+
+	//Check that status code is OK
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
+}
+
+func TestHandleRevisions(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//Make test request
+	r := httptest.NewRequest(http.MethodGet, "/revisions", nil)
+	r.SetPathValue("chatId", "1")
+	r.SetPathValue("messageId", "1")
+
+	//Put username in context so user is authorized
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handleRevisions(w, r)
+	res := w.Result()
+	defer assert.NoError(t, res.Body.Close())
+
+	//Check that status code is OK
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
+
+	//Decode json response
+	var revisions []store.Revision
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&revisions))
+
+	//Check that we got a correct response
+	assert.Equal(t, "hello world", revisions[0].Text)
+}
+
+func TestHandleRead(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//Make test request to mark messages as read
+	r := httptest.NewRequest(http.MethodPost, "/read", strings.NewReader(`{"seq":3}`))
+	r.SetPathValue("chatId", "1")
+
+	//Put username in context so user is authorized
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handleRead(w, r)
+	res := w.Result()
+	defer assert.NoError(t, res.Body.Close())
+
+	//Check that we got the read receipt
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
+	var read ws.Read
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&read))
+	assert.Equal(t, ws.Read{ChatId: "1", From: testUser.Username, Seq: 3}, read)
+
+	//Make test request to get read positions of chat members
+	r = httptest.NewRequest(http.MethodGet, "/read", nil)
+	r.SetPathValue("chatId", "1")
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w = httptest.NewRecorder()
+	s.handleRead(w, r)
+	res = w.Result()
+	defer assert.NoError(t, res.Body.Close())
+
+	//Check that we got a correct response
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
+	var state map[string]int64
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&state))
+	assert.Equal(t, int64(1), state[testUser.Username])
+
+	//Check that users who aren't members can't mark messages as read
+	r = httptest.NewRequest(http.MethodPost, "/read", strings.NewReader(`{"seq":3}`))
+	r.SetPathValue("chatId", "1")
+	r = r.WithContext(context.WithValue(context.Background(), "username", "stranger"))
+	w = httptest.NewRecorder()
+	s.handleRead(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestHandlePresence(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//Make test request
+	r := httptest.NewRequest(http.MethodGet, "/presence?users=usernameTest,other", nil)
+
+	//Put username in context so user is authorized
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handlePresence(w, r)
+	res := w.Result()
+	defer assert.NoError(t, res.Body.Close())
+
+	//Check that status code is OK
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
+
+	//Decode json response
+	var presence []ws.Presence
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&presence))
+
+	//Check that we got a correct response
+	assert.Equal(t, []ws.Presence{{Username: "usernameTest", LastSeen: 1}, {Username: "other"}}, presence)
+
+	//Check that request without users is refused
+	r = httptest.NewRequest(http.MethodGet, "/presence", nil)
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w = httptest.NewRecorder()
+	s.handlePresence(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandleDevices(t *testing.T) {
+	//Create server
+	s, err := createTestService()
+	assert.NoError(t, err)
+
+	//Make test request
+	r := httptest.NewRequest(http.MethodGet, "/devices", nil)
+
+	//Put username in context so user is authorized
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handleDevices(w, r)
+	res := w.Result()
+	defer assert.NoError(t, res.Body.Close())
+
+	//Check that status code is OK
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected 200 but got %d", res.StatusCode))
+
+	//Check that user without connected devices gets an empty list
+	var devices []ws.DeviceState
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&devices))
+	assert.Empty(t, devices)
+}
+
+func TestHandleMetrics(t *testing.T) {
+	//Create server with an admin
+	s, err := createTestService()
+	assert.NoError(t, err)
+	s.Admins = []string{"admin"}
+
+	//Check that users who aren't admins can't read metrics
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r = r.WithContext(context.WithValue(context.Background(), "username", testUser.Username))
+	w := httptest.NewRecorder()
+	s.handleMetrics(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	//Check that admins get metrics
+	r = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r = r.WithContext(context.WithValue(context.Background(), "username", "admin"))
+	w = httptest.NewRecorder()
+	s.handleMetrics(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var metrics ws.Metrics
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&metrics))
+}
+
 func createTestService() (*Server, error) {
 	//Create logger
 	logger, err := zap.NewDevelopment()
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when broker is used after it was closed
+var ErrClosed = errors.New("broker is closed")
+
+// Broker relays messages between server instances. Every published message is passed
+// to all subscribers of all instances connected to the same broker, including the publisher's own ones
+type Broker interface {
+	Publish(ctx context.Context, message []byte) error
+	// Subscribe calls handler for every published message until ctx is done or broker is closed.
+	// It returns once the subscription is active, handler is called from one goroutine at a time
+	Subscribe(ctx context.Context, handler func(message []byte)) error
+	Close() error
+}
+
+// MemoryBroker relays messages between subscribers in the same process.
+// It's used by single instance servers and to test several managers without a broker server
+type MemoryBroker struct {
+	mu          sync.RWMutex
+	subscribers map[int]*subscriber
+	lastId      int
+	closed      bool
+}
+
+// subscriber calls handler of a MemoryBroker subscription one message at a time
+type subscriber struct {
+	mu      sync.Mutex
+	handler func(message []byte)
+}
+
+// NewMemoryBroker creates new in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscribers: make(map[int]*subscriber)}
+}
+
+// Publish passes message to all subscribers before returning
+func (b *MemoryBroker) Publish(ctx context.Context, message []byte) error {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrClosed
+	}
+	subscribers := make([]*subscriber, 0, len(b.subscribers))
+	for _, sub := range b.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	b.mu.RUnlock()
+
+	//Call handlers outside the lock so they can publish too
+	for _, sub := range subscribers {
+		sub.mu.Lock()
+		sub.handler(message)
+		sub.mu.Unlock()
+	}
+	return nil
+}
+
+// Subscribe adds handler to the subscribers until ctx is done
+func (b *MemoryBroker) Subscribe(ctx context.Context, handler func(message []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+
+	b.lastId++
+	id := b.lastId
+	b.subscribers[id] = &subscriber{handler: handler}
+
+	//Unsubscribe when context is done
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		delete(b.subscribers, id)
+		b.mu.Unlock()
+	})
+	return nil
+}
+
+// Close removes all subscribers
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	clear(b.subscribers)
+	return nil
+}
@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	runBrokerSuite(t, NewMemoryBroker())
+}
+
+func TestRedisBroker(t *testing.T) {
+	//Use in-process Redis server
+	server := miniredis.RunT(t)
+	b, err := NewRedisBroker(context.Background(), "redis://"+server.Addr(), "")
+	assert.NoError(t, err)
+	runBrokerSuite(t, b)
+
+	//Check that invalid URIs are refused
+	_, err = NewRedisBroker(context.Background(), "localhost", "")
+	assert.Error(t, err)
+
+	//Check that unreachable servers are refused
+	addr := server.Addr()
+	server.Close()
+	_, err = NewRedisBroker(context.Background(), "redis://"+addr, "")
+	assert.Error(t, err)
+}
+
+// runBrokerSuite checks that published messages reach all active subscribers
+func runBrokerSuite(t *testing.T, b Broker) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//Subscribe twice, second subscription is cancelled later
+	first, second := make(chan string, 4), make(chan string, 4)
+	assert.NoError(t, b.Subscribe(ctx, func(message []byte) { first <- string(message) }))
+	secondCtx, cancelSecond := context.WithCancel(ctx)
+	assert.NoError(t, b.Subscribe(secondCtx, func(message []byte) { second <- string(message) }))
+
+	//Check that both subscribers get the message
+	assert.NoError(t, b.Publish(ctx, []byte("hello")))
+	assert.Equal(t, "hello", receive(t, first))
+	assert.Equal(t, "hello", receive(t, second))
+
+	//Check that cancelled subscription doesn't get messages
+	cancelSecond()
+	assert.Eventually(t, func() bool {
+		//Drop messages received before the subscription stopped
+		for len(second) > 0 {
+			<-second
+		}
+		assert.NoError(t, b.Publish(ctx, []byte("again")))
+		return receive(t, first) == "again" && len(second) == 0
+	}, time.Second, time.Millisecond*50)
+
+	//Check that closed broker refuses to publish
+	assert.NoError(t, b.Close())
+	assert.Error(t, b.Publish(ctx, []byte("closed")))
+}
+
+// receive waits for a message from the subscription
+func receive(t *testing.T, messages chan string) string {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(time.Second):
+		t.Fatal("message wasn't received")
+		return ""
+	}
+}
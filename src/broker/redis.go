@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultChannel is the pub/sub channel used when the broker URI doesn't set one
+const DefaultChannel = "messenger"
+
+// RedisBroker relays messages through a pub/sub channel of a Redis compatible server
+type RedisBroker struct {
+	client  *redis.Client
+	channel string
+	//done is closed on Close to stop subscriptions, wg waits for them
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewRedisBroker connects to the server at uri, for example redis://localhost:6379/0.
+// Messages are published to the channel, DefaultChannel is used if channel is empty
+func NewRedisBroker(ctx context.Context, uri, channel string) (*RedisBroker, error) {
+	options, err := redis.ParseURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	if channel == "" {
+		channel = DefaultChannel
+	}
+
+	//Check the connection
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, errors.Join(err, client.Close())
+	}
+	return &RedisBroker{client: client, channel: channel, done: make(chan struct{})}, nil
+}
+
+// Publish publishes message to the channel
+func (b *RedisBroker) Publish(ctx context.Context, message []byte) error {
+	return b.client.Publish(ctx, b.channel, message).Err()
+}
+
+// Subscribe subscribes to the channel and calls handler from a separate goroutine
+func (b *RedisBroker) Subscribe(ctx context.Context, handler func(message []byte)) error {
+	pubsub := b.client.Subscribe(ctx, b.channel)
+
+	//Wait for the subscription confirmation so messages published after return aren't missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-b.done:
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				handler([]byte(message.Payload))
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops subscriptions and closes the connection
+func (b *RedisBroker) Close() error {
+	close(b.done)
+	b.wg.Wait()
+	return b.client.Close()
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	//DefaultPageLimit is used when MessageQuery has no limit
+	DefaultPageLimit = 50
+	//MaxPageLimit is the largest number of messages returned in one page
+	MaxPageLimit = 200
+)
+
+var ErrInvalidCursor = fmt.Errorf("invalid cursor")
+
+// MessageQuery describes a page of chat messages. Before and After are cursors taken from a MessagePage.
+// If neither is set the newest messages are returned
+type MessageQuery struct {
+	Before string
+	After  string
+	Limit  int
+}
+
+// MessagePage is a page of chat messages sorted newest first
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	//Before is a cursor for the older page. Empty if there are no older messages
+	Before string `json:"before,omitempty"`
+	//After is a cursor for the newer page. Empty if there are no newer messages
+	After string `json:"after,omitempty"`
+}
+
+// cursor is a position of a message in a chat. Messages are ordered by time and then by id
+type cursor struct {
+	time int64
+	id   string
+}
+
+// messageCursor returns cursor pointing to the message
+func messageCursor(msg Message) cursor {
+	return cursor{time: msg.Time, id: msg.Id}
+}
+
+// String encodes cursor so it can be passed to the client
+func (c cursor) String() string {
+	return strconv.FormatInt(c.time, 10) + "_" + c.id
+}
+
+// less reports whether cursor c is positioned before other
+func (c cursor) less(other cursor) bool {
+	if c.time != other.time {
+		return c.time < other.time
+	}
+	return c.id < other.id
+}
+
+// parseCursor decodes cursor received from the client
+func parseCursor(s string) (cursor, error) {
+	t, id, ok := strings.Cut(s, "_")
+	if !ok || id == "" {
+		return cursor{}, ErrInvalidCursor
+	}
+	parsed, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+	return cursor{time: parsed, id: id}, nil
+}
+
+// pageQuery is a validated MessageQuery
+type pageQuery struct {
+	before *cursor
+	after  *cursor
+	limit  int
+}
+
+// parse validates the query and decodes its cursors
+func (q MessageQuery) parse() (pageQuery, error) {
+	pq := pageQuery{limit: q.Limit}
+	if pq.limit <= 0 {
+		pq.limit = DefaultPageLimit
+	}
+	pq.limit = min(pq.limit, MaxPageLimit)
+
+	if q.Before != "" && q.After != "" {
+		return pageQuery{}, fmt.Errorf("%w: before and after can't be used together", ErrInvalidCursor)
+	}
+	if q.Before != "" {
+		c, err := parseCursor(q.Before)
+		if err != nil {
+			return pageQuery{}, err
+		}
+		pq.before = &c
+	}
+	if q.After != "" {
+		c, err := parseCursor(q.After)
+		if err != nil {
+			return pageQuery{}, err
+		}
+		pq.after = &c
+	}
+	return pq, nil
+}
+
+// newPage builds a page from messages fetched by a backend. Messages must be sorted newest first
+// for before and latest queries and oldest first for after queries, and contain up to limit+1 items
+// so the backend can tell whether there are more messages
+func newPage(q pageQuery, messages []Message) *MessagePage {
+	page := &MessagePage{Messages: []Message{}}
+	more := len(messages) > q.limit
+	if more {
+		messages = messages[:q.limit]
+	}
+
+	if q.after != nil {
+		//After queries are fetched oldest first, reverse them so pages are always newest first
+		for i := len(messages) - 1; i >= 0; i-- {
+			page.Messages = append(page.Messages, messages[i])
+		}
+		if len(messages) > 0 {
+			//There is always an older message: the one the cursor points to
+			page.Before = messageCursor(messages[0]).String()
+			if more {
+				page.After = messageCursor(messages[len(messages)-1]).String()
+			}
+		}
+		return page
+	}
+
+	page.Messages = append(page.Messages, messages...)
+	if len(messages) > 0 {
+		if more {
+			page.Before = messageCursor(messages[len(messages)-1]).String()
+		}
+		if q.before != nil {
+			//There is always a newer message: the one the cursor points to
+			page.After = messageCursor(messages[0]).String()
+		}
+	}
+	return page
+}
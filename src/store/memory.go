@@ -0,0 +1,434 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore is an in-memory implementation of Storer. It keeps all data in process memory
+// so the server can be run and tested without a database
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+	chats []Chat
+	//messages stores chat messages sorted by time and id
+	messages map[string][]Message
+	//lastSeq stores the last sequence number assigned in a chat
+	lastSeq map[string]int64
+	//revisions stores previous versions of edited messages by message id
+	revisions map[string][]Revision
+	//hidden stores ids of messages hidden by a user in a chat
+	hidden map[memberKey]map[string]bool
+	//reads stores last read sequence number of a user in a chat
+	reads map[memberKey]int64
+	//lastSeen stores time when user was last online by username
+	lastSeen map[string]int64
+}
+
+// memberKey identifies a user in a chat
+type memberKey struct {
+	chatId   string
+	username string
+}
+
+// NewMemoryStore creates new empty in-memory storage
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:     make(map[string]User),
+		messages:  make(map[string][]Message),
+		lastSeq:   make(map[string]int64),
+		revisions: make(map[string][]Revision),
+		hidden:    make(map[memberKey]map[string]bool),
+		reads:     make(map[memberKey]int64),
+		lastSeen:  make(map[string]int64),
+	}
+}
+
+// NewUser adds new user to the storage using username and password
+func (s *MemoryStore) NewUser(ctx context.Context, username, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//Return error if user with the same username already exists
+	if _, ok := s.users[username]; ok {
+		return ErrUserExists
+	}
+
+	s.users[username] = User{Id: primitive.NewObjectID().Hex(), Username: username, Password: password}
+	return nil
+}
+
+// GetUser returns all user info
+func (s *MemoryStore) GetUser(ctx context.Context, username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+// NewChat creates new chat using members and owner fields. Returns chat id.
+// For 2-member chats, returns the existing chat id if one already exists.
+func (s *MemoryStore) NewChat(ctx context.Context, members []string, owner string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(members) == 2 {
+		for _, chat := range s.chats {
+			if len(chat.Members) == 2 && slices.Contains(chat.Members, members[0]) && slices.Contains(chat.Members, members[1]) {
+				return primitive.ObjectIDFromHex(chat.Id)
+			}
+		}
+	}
+
+	id := primitive.NewObjectID()
+	s.chats = append(s.chats, Chat{Id: id.Hex(), Members: slices.Clone(members), Owner: owner})
+	return id, nil
+}
+
+// GetChat returns chat info by chat id
+func (s *MemoryStore) GetChat(ctx context.Context, chatId string) (*Chat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.chatIndex(chatId)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	chat := cloneChat(s.chats[i])
+	return &chat, nil
+}
+
+// GetChats returns all chats where user is a member
+func (s *MemoryStore) GetChats(ctx context.Context, username string) ([]Chat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var chats []Chat
+	for _, chat := range s.chats {
+		if slices.Contains(chat.Members, username) {
+			chats = append(chats, cloneChat(chat))
+		}
+	}
+	return chats, nil
+}
+
+// GetMessages returns list of messages in a chat by chat id sorted oldest first
+func (s *MemoryStore) GetMessages(ctx context.Context, chatId string) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.messages[chatId]), nil
+}
+
+// GetMessagesPage returns a page of messages in a chat sorted newest first
+func (s *MemoryStore) GetMessagesPage(ctx context.Context, chatId string, query MessageQuery) (*MessagePage, error) {
+	//Validate the query
+	q, err := query.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stored := s.messages[chatId]
+
+	//Collect up to limit+1 messages past the cursor so the page knows if there are more
+	var messages []Message
+	collect := func(msg Message) bool {
+		messages = append(messages, msg)
+		return len(messages) <= q.limit
+	}
+
+	if q.after != nil {
+		//Walk forward starting after the cursor
+		i, found := s.search(chatId, *q.after)
+		if found {
+			i++
+		}
+		for ; i < len(stored); i++ {
+			if !collect(stored[i]) {
+				break
+			}
+		}
+		return newPage(q, messages), nil
+	}
+
+	//Walk backward starting before the cursor or from the newest message
+	i := len(stored)
+	if q.before != nil {
+		i, _ = s.search(chatId, *q.before)
+	}
+	for i--; i >= 0; i-- {
+		if !collect(stored[i]) {
+			break
+		}
+	}
+	return newPage(q, messages), nil
+}
+
+// GetMessagesSince returns up to limit messages in a chat with sequence number greater than seq sorted oldest first
+func (s *MemoryStore) GetMessagesSince(ctx context.Context, chatId string, seq int64, limit int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	//Messages are sorted by time, so collect the missed ones and sort them by sequence number
+	var messages []Message
+	for _, msg := range s.messages[chatId] {
+		if msg.Seq > seq {
+			messages = append(messages, msg)
+		}
+	}
+	slices.SortFunc(messages, func(a, b Message) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// SaveMessage saves message to the storage and returns it with assigned id and sequence number
+func (s *MemoryStore) SaveMessage(ctx context.Context, msg Message) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//Check that chat exists
+	if s.chatIndex(msg.ChatId) < 0 {
+		return nil, ErrNotFound
+	}
+
+	//Assign id and the next sequence number of the chat
+	s.lastSeq[msg.ChatId]++
+	msg.Id, msg.Seq = primitive.NewObjectID().Hex(), s.lastSeq[msg.ChatId]
+
+	//Insert message keeping chat messages sorted
+	i, _ := s.search(msg.ChatId, messageCursor(msg))
+	s.messages[msg.ChatId] = slices.Insert(s.messages[msg.ChatId], i, msg)
+	return &msg, nil
+}
+
+// GetMessage returns a message from a chat by message id
+func (s *MemoryStore) GetMessage(ctx context.Context, chatId, messageId string) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.messageIndex(chatId, messageId)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	msg := s.messages[chatId][i]
+	return &msg, nil
+}
+
+// EditMessage replaces message text and keeps the previous text as a revision
+func (s *MemoryStore) EditMessage(ctx context.Context, chatId, messageId, text string, editedAt int64) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.messageIndex(chatId, messageId)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+
+	//Save current text as a revision and replace it
+	msg := &s.messages[chatId][i]
+	s.revisions[messageId] = append(s.revisions[messageId], Revision{Text: msg.Text, Time: msg.revisionTime()})
+	msg.Text, msg.EditedAt = text, editedAt
+	edited := *msg
+	return &edited, nil
+}
+
+// GetRevisions returns previous versions of a message sorted oldest first
+func (s *MemoryStore) GetRevisions(ctx context.Context, chatId, messageId string) ([]Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.messageIndex(chatId, messageId) < 0 {
+		return nil, ErrNotFound
+	}
+	return append([]Revision{}, s.revisions[messageId]...), nil
+}
+
+// DeleteMessage deletes message for everyone. Message text and revisions are removed
+// but the message is kept as a tombstone so clients know it was deleted
+func (s *MemoryStore) DeleteMessage(ctx context.Context, chatId, messageId string, deletedAt int64) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.messageIndex(chatId, messageId)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+
+	//Remove text and revisions
+	msg := &s.messages[chatId][i]
+	msg.Text, msg.DeletedAt = "", deletedAt
+	delete(s.revisions, messageId)
+	deleted := *msg
+	return &deleted, nil
+}
+
+// HideMessage hides message from a single user
+func (s *MemoryStore) HideMessage(ctx context.Context, chatId, messageId, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.messageIndex(chatId, messageId) < 0 {
+		return ErrNotFound
+	}
+
+	key := memberKey{chatId: chatId, username: username}
+	if s.hidden[key] == nil {
+		s.hidden[key] = make(map[string]bool)
+	}
+	s.hidden[key][messageId] = true
+	return nil
+}
+
+// GetHiddenMessages returns ids of messages in a chat hidden by the user
+func (s *MemoryStore) GetHiddenMessages(ctx context.Context, chatId, username string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := []string{}
+	for id := range s.hidden[memberKey{chatId: chatId, username: username}] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// RemoveUserFromChat removes user from a specific chat by deleting username from the members list
+func (s *MemoryStore) RemoveUserFromChat(ctx context.Context, username, chatId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.chatIndex(chatId)
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.chats[i].Members = slices.DeleteFunc(s.chats[i].Members, func(member string) bool {
+		return member == username
+	})
+	return nil
+}
+
+// MarkRead moves last read position of the user in a chat forward to the sequence number and returns the new position.
+// Position never moves back and never goes past the last message of the chat
+func (s *MemoryStore) MarkRead(ctx context.Context, chatId, username string, seq int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chatIndex(chatId) < 0 {
+		return 0, ErrNotFound
+	}
+
+	key := memberKey{chatId: chatId, username: username}
+	s.reads[key] = max(s.reads[key], min(seq, s.lastSeq[chatId]))
+	return s.reads[key], nil
+}
+
+// GetReadState returns last read positions of users in a chat by username
+func (s *MemoryStore) GetReadState(ctx context.Context, chatId string) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state := make(map[string]int64)
+	for key, seq := range s.reads {
+		if key.chatId == chatId {
+			state[key.username] = seq
+		}
+	}
+	return state, nil
+}
+
+// GetUnreadCounts returns number of unread messages in user chats by chat id.
+// Messages sent by the user and deleted messages are not counted
+func (s *MemoryStore) GetUnreadCounts(ctx context.Context, username string) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int64)
+	for _, chat := range s.chats {
+		if !slices.Contains(chat.Members, username) {
+			continue
+		}
+		read := s.reads[memberKey{chatId: chat.Id, username: username}]
+		counts[chat.Id] = 0
+		for _, msg := range s.messages[chat.Id] {
+			if msg.Seq > read && msg.From != username && msg.DeletedAt == 0 {
+				counts[chat.Id]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// SetLastSeen saves time when user was last online
+func (s *MemoryStore) SetLastSeen(ctx context.Context, username string, lastSeen int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; !ok {
+		return ErrNotFound
+	}
+	s.lastSeen[username] = lastSeen
+	return nil
+}
+
+// GetLastSeen returns time when users were last online by username. Users that have never been online are omitted
+func (s *MemoryStore) GetLastSeen(ctx context.Context, usernames []string) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lastSeen := make(map[string]int64)
+	for _, username := range usernames {
+		if seen, ok := s.lastSeen[username]; ok {
+			lastSeen[username] = seen
+		}
+	}
+	return lastSeen, nil
+}
+
+// chatIndex returns index of the chat in the chats slice or -1 if chat does not exist.
+// Must be called with mu held
+func (s *MemoryStore) chatIndex(chatId string) int {
+	return slices.IndexFunc(s.chats, func(chat Chat) bool {
+		return chat.Id == chatId
+	})
+}
+
+// messageIndex returns index of the message in chat messages or -1 if message does not exist.
+// Must be called with mu held
+func (s *MemoryStore) messageIndex(chatId, messageId string) int {
+	return slices.IndexFunc(s.messages[chatId], func(msg Message) bool {
+		return msg.Id == messageId
+	})
+}
+
+// search returns position of the cursor in chat messages and whether a message with this cursor exists.
+// Must be called with mu held
+func (s *MemoryStore) search(chatId string, c cursor) (int, bool) {
+	return slices.BinarySearchFunc(s.messages[chatId], c, func(msg Message, target cursor) int {
+		switch {
+		case messageCursor(msg).less(target):
+			return -1
+		case target.less(messageCursor(msg)):
+			return 1
+		}
+		return 0
+	})
+}
+
+// cloneChat returns a copy of the chat so callers can't modify stored members
+func cloneChat(chat Chat) Chat {
+	chat.Members = slices.Clone(chat.Members)
+	return chat
+}
@@ -0,0 +1,9 @@
+package store
+
+import "testing"
+
+func TestMemoryStore(t *testing.T) {
+	runStorerSuite(t, func(t *testing.T) Storer {
+		return NewMemoryStore()
+	})
+}
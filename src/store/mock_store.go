@@ -39,10 +39,63 @@ func (s *MockStore) GetMessages(ctx context.Context, chatId string) ([]Message,
 	return []Message{{ChatId: chatId, Text: "hello world"}}, nil
 }
 
-func (s *MockStore) SaveMessage(ctx context.Context, msg Message) error {
+func (s *MockStore) GetMessagesPage(ctx context.Context, chatId string, query MessageQuery) (*MessagePage, error) {
+	return &MessagePage{Messages: []Message{{ChatId: chatId, Text: "hello world"}}}, nil
+}
+
+func (s *MockStore) GetMessagesSince(ctx context.Context, chatId string, seq int64, limit int) ([]Message, error) {
+	return []Message{{Id: "2", ChatId: chatId, From: "usernameTest", Text: "hello world", Seq: seq + 1}}, nil
+}
+
+func (s *MockStore) SaveMessage(ctx context.Context, msg Message) (*Message, error) {
+	msg.Id, msg.Seq = "1", 1
+	return &msg, nil
+}
+
+func (s *MockStore) GetMessage(ctx context.Context, chatId, messageId string) (*Message, error) {
+	return &Message{Id: messageId, ChatId: chatId, From: "usernameTest", Text: "hello world", Seq: 1}, nil
+}
+
+func (s *MockStore) EditMessage(ctx context.Context, chatId, messageId, text string, editedAt int64) (*Message, error) {
+	return &Message{Id: messageId, ChatId: chatId, From: "usernameTest", Text: text, Seq: 1, EditedAt: editedAt}, nil
+}
+
+func (s *MockStore) GetRevisions(ctx context.Context, chatId, messageId string) ([]Revision, error) {
+	return []Revision{{Text: "hello world"}}, nil
+}
+
+func (s *MockStore) DeleteMessage(ctx context.Context, chatId, messageId string, deletedAt int64) (*Message, error) {
+	return &Message{Id: messageId, ChatId: chatId, From: "usernameTest", Seq: 1, DeletedAt: deletedAt}, nil
+}
+
+func (s *MockStore) HideMessage(ctx context.Context, chatId, messageId, username string) error {
 	return nil
 }
 
+func (s *MockStore) GetHiddenMessages(ctx context.Context, chatId, username string) ([]string, error) {
+	return []string{}, nil
+}
+
 func (s *MockStore) RemoveUserFromChat(ctx context.Context, username, chatId string) error {
 	return nil
 }
+
+func (s *MockStore) MarkRead(ctx context.Context, chatId, username string, seq int64) (int64, error) {
+	return seq, nil
+}
+
+func (s *MockStore) GetReadState(ctx context.Context, chatId string) (map[string]int64, error) {
+	return map[string]int64{"usernameTest": 1}, nil
+}
+
+func (s *MockStore) GetUnreadCounts(ctx context.Context, username string) (map[string]int64, error) {
+	return map[string]int64{}, nil
+}
+
+func (s *MockStore) SetLastSeen(ctx context.Context, username string, lastSeen int64) error {
+	return nil
+}
+
+func (s *MockStore) GetLastSeen(ctx context.Context, usernames []string) (map[string]int64, error) {
+	return map[string]int64{"usernameTest": 1}, nil
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	runStorerSuite(t, func(t *testing.T) Storer {
+		//Create new database file for every test
+		storage, err := OpenSQL(context.Background(), "sqlite://"+filepath.Join(t.TempDir(), "test.db"))
+		assert.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, storage.Close()) })
+		return storage
+	})
+}
+
+func TestPostgresStore(t *testing.T) {
+	//PostgreSQL tests are run only when a database is provided
+	uri := os.Getenv("POSTGRES_URI")
+	if uri == "" {
+		t.Skip("POSTGRES_URI is not set")
+	}
+
+	runStorerSuite(t, func(t *testing.T) Storer {
+		storage, err := OpenSQL(context.Background(), uri)
+		assert.NoError(t, err)
+		assert.NoError(t, clearSQLStorage(storage.db))
+		t.Cleanup(func() { assert.NoError(t, storage.Close()) })
+		return storage
+	})
+}
+
+func TestOpenSQL(t *testing.T) {
+	//Check that unknown schemes are refused
+	_, err := OpenSQL(context.Background(), "mysql://localhost/messenger")
+	assert.Error(t, err)
+
+	//Check that the schema can be created twice on the same database
+	path := "sqlite://" + filepath.Join(t.TempDir(), "test.db")
+	for i := 0; i < 2; i++ {
+		storage, err := OpenSQL(context.Background(), path)
+		assert.NoError(t, err)
+		assert.NoError(t, storage.Close())
+	}
+}
+
+func TestRebind(t *testing.T) {
+	s := &SQLStore{dialect: DialectPostgres}
+	assert.Equal(t, "SELECT 1 WHERE a = $1 AND b = $2", s.rebind("SELECT 1 WHERE a = ? AND b = ?"))
+
+	s = &SQLStore{dialect: DialectSQLite}
+	assert.Equal(t, "SELECT 1 WHERE a = ?", s.rebind("SELECT 1 WHERE a = ?"))
+}
+
+func clearSQLStorage(db *sql.DB) error {
+	for _, table := range []string{"read_state", "hidden_messages", "message_revisions", "messages", "chat_members", "chats", "users"} {
+		if _, err := db.Exec("DELETE FROM " + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
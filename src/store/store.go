@@ -7,9 +7,13 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var ErrUserExists = fmt.Errorf("user exists")
+var (
+	ErrUserExists = fmt.Errorf("user exists")
+	ErrNotFound   = fmt.Errorf("not found")
+)
 
 type Storer interface {
 	NewUser(ctx context.Context, username string, password string) error
@@ -18,8 +22,21 @@ type Storer interface {
 	GetChat(ctx context.Context, chatId string) (*Chat, error)
 	GetChats(ctx context.Context, username string) ([]Chat, error)
 	GetMessages(ctx context.Context, chatId string) ([]Message, error)
-	SaveMessage(ctx context.Context, msg Message) error
+	GetMessagesPage(ctx context.Context, chatId string, query MessageQuery) (*MessagePage, error)
+	GetMessagesSince(ctx context.Context, chatId string, seq int64, limit int) ([]Message, error)
+	SaveMessage(ctx context.Context, msg Message) (*Message, error)
+	GetMessage(ctx context.Context, chatId string, messageId string) (*Message, error)
+	EditMessage(ctx context.Context, chatId string, messageId string, text string, editedAt int64) (*Message, error)
+	GetRevisions(ctx context.Context, chatId string, messageId string) ([]Revision, error)
+	DeleteMessage(ctx context.Context, chatId string, messageId string, deletedAt int64) (*Message, error)
+	HideMessage(ctx context.Context, chatId string, messageId string, username string) error
+	GetHiddenMessages(ctx context.Context, chatId string, username string) ([]string, error)
 	RemoveUserFromChat(ctx context.Context, username string, chatId string) error
+	MarkRead(ctx context.Context, chatId string, username string, seq int64) (int64, error)
+	GetReadState(ctx context.Context, chatId string) (map[string]int64, error)
+	GetUnreadCounts(ctx context.Context, username string) (map[string]int64, error)
+	SetLastSeen(ctx context.Context, username string, lastSeen int64) error
+	GetLastSeen(ctx context.Context, usernames []string) (map[string]int64, error)
 }
 
 type Storage struct {
@@ -39,11 +56,33 @@ type Chat struct {
 }
 
 type Message struct {
+	Id     string `bson:"_id"     json:"id"`
 	ChatId string `bson:"chat_id" json:"chat_id"`
 	From   string `bson:"from"    json:"from"`
 	Text   string `bson:"text"    json:"text"`
 	//Unix utc time
 	Time int64 `bson:"time"    json:"time"`
+	//Sequence number assigned by the storage, grows monotonically within a chat
+	Seq int64 `bson:"seq"     json:"seq"`
+	//Unix utc time of the last edit, 0 if message has never been edited
+	EditedAt int64 `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	//Unix utc time when message was deleted for everyone, 0 if message isn't deleted
+	DeletedAt int64 `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+}
+
+// Revision is a previous version of an edited message
+type Revision struct {
+	Text string `bson:"text" json:"text"`
+	//Unix utc time when this version was written
+	Time int64 `bson:"time" json:"time"`
+}
+
+// revisionTime returns time when the current version of the message was written
+func (m Message) revisionTime() int64 {
+	if m.EditedAt != 0 {
+		return m.EditedAt
+	}
+	return m.Time
 }
 
 // New creates new storage instance with mongo client as the only field
@@ -53,22 +92,48 @@ func New(client *mongo.Client) *Storage {
 	}
 }
 
+// CreateIndexes creates indexes used by storage queries
+func (s *Storage) CreateIndexes(ctx context.Context) error {
+	//Get messages collection
+	coll := s.db.Database("messenger").Collection("messages")
+
+	//Messages are fetched by chat and sorted by time, _id is used as a tiebreaker
+	//Missed messages are fetched by chat and sequence number
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "time", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "seq", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	//Usernames are unique
+	_, err = s.db.Database("messenger").Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	//Every user has one read position per chat, see MarkRead
+	_, err = s.db.Database("messenger").Collection("reads").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "chat_id", Value: 1}, {Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
 // NewUser adds new user to the database using username and password
 func (s *Storage) NewUser(ctx context.Context, username, password string) error {
 	//Get users collection
 	coll := s.db.Database("messenger").Collection("users")
 
-	//Check if user exists
-	var u User
-	err := coll.FindOne(ctx, bson.D{{Key: "username", Value: username}}).Decode(&u)
-
-	//Return error if user with the same username already exists
-	if !errors.Is(err, mongo.ErrNoDocuments) {
+	//Create new user in the database, usernames are unique so concurrent registrations can't both succeed
+	_, err := coll.InsertOne(ctx, bson.D{{Key: "username", Value: username}, {Key: "password", Value: password}})
+	if mongo.IsDuplicateKeyError(err) {
 		return ErrUserExists
 	}
-
-	//Create new user in the database
-	_, err = coll.InsertOne(ctx, bson.D{{Key: "username", Value: username}, {Key: "password", Value: password}})
 	return err
 }
 
@@ -80,6 +145,9 @@ func (s *Storage) GetUser(ctx context.Context, username string) (*User, error) {
 	//Get user from the database by username
 	var user User
 	if err := coll.FindOne(ctx, bson.D{{Key: "username", Value: username}}).Decode(&user); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
 	return &user, nil
@@ -118,12 +186,15 @@ func (s *Storage) GetChat(ctx context.Context, chatId string) (*Chat, error) {
 	//Convert chatId to objectId type
 	objId, err := primitive.ObjectIDFromHex(chatId)
 	if err != nil {
-		return nil, err
+		return nil, ErrNotFound
 	}
 
 	//Get chat info from the database
 	var chat Chat
 	if err := coll.FindOne(ctx, bson.D{{Key: "_id", Value: objId}}).Decode(&chat); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
 	return &chat, nil
@@ -149,14 +220,15 @@ func (s *Storage) GetChats(ctx context.Context, username string) ([]Chat, error)
 	return chats, nil
 }
 
-// GetMessages returns list of messages in a chat by chat id
+// GetMessages returns list of messages in a chat by chat id sorted oldest first
 func (s *Storage) GetMessages(ctx context.Context, chatId string) ([]Message, error) {
 	//Get messages collection
 	coll := s.db.Database("messenger").Collection("messages")
 
 	//Find messages from a specific chat
 	var messages []Message
-	cursor, err := coll.Find(ctx, bson.D{{"chat_id", chatId}})
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := coll.Find(ctx, bson.D{{"chat_id", chatId}}, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -168,14 +240,276 @@ func (s *Storage) GetMessages(ctx context.Context, chatId string) ([]Message, er
 	return messages, nil
 }
 
-// SaveMessage saves message to the database
-func (s *Storage) SaveMessage(ctx context.Context, msg Message) error {
+// GetMessagesPage returns a page of messages in a chat sorted newest first
+func (s *Storage) GetMessagesPage(ctx context.Context, chatId string, query MessageQuery) (*MessagePage, error) {
+	//Validate the query
+	q, err := query.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	//Get messages collection
+	coll := s.db.Database("messenger").Collection("messages")
+
+	//Newest messages are fetched first unless we page forward
+	filter := bson.D{{Key: "chat_id", Value: chatId}}
+	from, op, order := q.before, "$lt", -1
+	if q.after != nil {
+		from, op, order = q.after, "$gt", 1
+	}
+
+	//Only fetch messages past the cursor
+	if from != nil {
+		objId, err := primitive.ObjectIDFromHex(from.id)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "time", Value: bson.D{{Key: op, Value: from.time}}}},
+			bson.D{{Key: "time", Value: from.time}, {Key: "_id", Value: bson.D{{Key: op, Value: objId}}}},
+		}})
+	}
+
+	//Fetch one extra message to know if there are more
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(int64(q.limit + 1))
+	cur, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	//Parse messages into messages struct
+	var messages []Message
+	if err = cur.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return newPage(q, messages), nil
+}
+
+// GetMessagesSince returns up to limit messages in a chat with sequence number greater than seq sorted oldest first
+func (s *Storage) GetMessagesSince(ctx context.Context, chatId string, seq int64, limit int) ([]Message, error) {
 	//Get messages collection
 	coll := s.db.Database("messenger").Collection("messages")
 
+	//Find messages sent after the sequence number
+	var messages []Message
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := coll.Find(ctx, bson.D{{Key: "chat_id", Value: chatId}, {Key: "seq", Value: bson.D{{Key: "$gt", Value: seq}}}}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	//Parse messages into messages struct
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// SaveMessage saves message to the database and returns it with assigned id and sequence number
+func (s *Storage) SaveMessage(ctx context.Context, msg Message) (*Message, error) {
+	//Convert chatId to objectId type
+	chatObjId, err := primitive.ObjectIDFromHex(msg.ChatId)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	//Increment sequence number of the chat
+	var chat struct {
+		LastSeq int64 `bson:"last_seq"`
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.D{{Key: "last_seq", Value: 1}})
+	if err := s.db.Database("messenger").Collection("chats").FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: chatObjId}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "last_seq", Value: 1}}}},
+		opts,
+	).Decode(&chat); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
 	//Create new message in the database
-	_, err := coll.InsertOne(ctx, msg)
-	return err
+	objId := primitive.NewObjectID()
+	msg.Id, msg.Seq = objId.Hex(), chat.LastSeq
+	if _, err := s.db.Database("messenger").Collection("messages").InsertOne(ctx, bson.D{
+		{Key: "_id", Value: objId},
+		{Key: "chat_id", Value: msg.ChatId},
+		{Key: "seq", Value: msg.Seq},
+		{Key: "from", Value: msg.From},
+		{Key: "text", Value: msg.Text},
+		{Key: "time", Value: msg.Time},
+	}); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// GetMessage returns a message from a chat by message id
+func (s *Storage) GetMessage(ctx context.Context, chatId, messageId string) (*Message, error) {
+	//Get messages collection
+	coll := s.db.Database("messenger").Collection("messages")
+
+	//Convert messageId to objectId type
+	objId, err := primitive.ObjectIDFromHex(messageId)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	//Get message from the database
+	var msg Message
+	if err := coll.FindOne(ctx, bson.D{{Key: "_id", Value: objId}, {Key: "chat_id", Value: chatId}}).Decode(&msg); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// EditMessage replaces message text and keeps the previous text as a revision
+func (s *Storage) EditMessage(ctx context.Context, chatId, messageId, text string, editedAt int64) (*Message, error) {
+	//Get messages collection
+	coll := s.db.Database("messenger").Collection("messages")
+
+	//Convert messageId to objectId type
+	objId, err := primitive.ObjectIDFromHex(messageId)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	//Push current text to revisions and replace it in a single update so concurrent edits don't lose revisions
+	update := bson.A{bson.D{{Key: "$set", Value: bson.D{
+		{Key: "revisions", Value: bson.D{{Key: "$concatArrays", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$revisions", bson.A{}}}},
+			bson.A{bson.D{
+				{Key: "text", Value: "$text"},
+				{Key: "time", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$edited_at", "$time"}}}},
+			}},
+		}}}},
+		{Key: "text", Value: text},
+		{Key: "edited_at", Value: editedAt},
+	}}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var msg Message
+	if err := coll.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: objId}, {Key: "chat_id", Value: chatId}}, update, opts).Decode(&msg); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// GetRevisions returns previous versions of a message sorted oldest first
+func (s *Storage) GetRevisions(ctx context.Context, chatId, messageId string) ([]Revision, error) {
+	//Get messages collection
+	coll := s.db.Database("messenger").Collection("messages")
+
+	//Convert messageId to objectId type
+	objId, err := primitive.ObjectIDFromHex(messageId)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	//Get only revisions of the message
+	var msg struct {
+		Revisions []Revision `bson:"revisions"`
+	}
+	opts := options.FindOne().SetProjection(bson.D{{Key: "revisions", Value: 1}})
+	if err := coll.FindOne(ctx, bson.D{{Key: "_id", Value: objId}, {Key: "chat_id", Value: chatId}}, opts).Decode(&msg); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if msg.Revisions == nil {
+		return []Revision{}, nil
+	}
+	return msg.Revisions, nil
+}
+
+// DeleteMessage deletes message for everyone. Message text and revisions are removed
+// but the message is kept as a tombstone so clients know it was deleted
+func (s *Storage) DeleteMessage(ctx context.Context, chatId, messageId string, deletedAt int64) (*Message, error) {
+	//Get messages collection
+	coll := s.db.Database("messenger").Collection("messages")
+
+	//Convert messageId to objectId type
+	objId, err := primitive.ObjectIDFromHex(messageId)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	//Remove text and revisions
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "text", Value: ""}, {Key: "deleted_at", Value: deletedAt}}},
+		{Key: "$unset", Value: bson.D{{Key: "revisions", Value: ""}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var msg Message
+	if err := coll.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: objId}, {Key: "chat_id", Value: chatId}}, update, opts).Decode(&msg); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// HideMessage hides message from a single user by adding username to the hidden_for array
+func (s *Storage) HideMessage(ctx context.Context, chatId, messageId, username string) error {
+	//Get messages collection
+	coll := s.db.Database("messenger").Collection("messages")
+
+	//Convert messageId to objectId type
+	objId, err := primitive.ObjectIDFromHex(messageId)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	//Add user to the hidden_for array
+	res, err := coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: objId}, {Key: "chat_id", Value: chatId}},
+		bson.D{{Key: "$addToSet", Value: bson.D{{Key: "hidden_for", Value: username}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetHiddenMessages returns ids of messages in a chat hidden by the user
+func (s *Storage) GetHiddenMessages(ctx context.Context, chatId, username string) ([]string, error) {
+	//Get messages collection
+	coll := s.db.Database("messenger").Collection("messages")
+
+	//Find ids of hidden messages
+	opts := options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := coll.Find(ctx, bson.D{{Key: "chat_id", Value: chatId}, {Key: "hidden_for", Value: username}}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	//Parse ids
+	var docs []struct {
+		Id string `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.Id)
+	}
+	return ids, nil
 }
 
 // RemoveUserFromChat removes user from a specific by deleting username from the members array
@@ -186,10 +520,177 @@ func (s *Storage) RemoveUserFromChat(ctx context.Context, username, chatId strin
 	//Convert chatId to object id type
 	objId, err := primitive.ObjectIDFromHex(chatId)
 	if err != nil {
-		return err
+		return ErrNotFound
 	}
 
 	//Delete user from members array
-	_, err = coll.UpdateOne(ctx, bson.D{{"_id", objId}}, bson.D{{"$pull", bson.D{{"members", username}}}})
-	return err
+	result, err := coll.UpdateOne(ctx, bson.D{{"_id", objId}}, bson.D{{"$pull", bson.D{{"members", username}}}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MarkRead moves last read position of the user in a chat forward to the sequence number and returns the new position.
+// Position never moves back and never goes past the last message of the chat
+func (s *Storage) MarkRead(ctx context.Context, chatId, username string, seq int64) (int64, error) {
+	//Convert chatId to objectId type
+	chatObjId, err := primitive.ObjectIDFromHex(chatId)
+	if err != nil {
+		return 0, ErrNotFound
+	}
+
+	//Get last sequence number of the chat
+	var chat struct {
+		LastSeq int64 `bson:"last_seq"`
+	}
+	opts := options.FindOne().SetProjection(bson.D{{Key: "last_seq", Value: 1}})
+	if err := s.db.Database("messenger").Collection("chats").FindOne(ctx, bson.D{{Key: "_id", Value: chatObjId}}, opts).Decode(&chat); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+
+	//Move read position forward. Concurrent upserts of a new position may both try to insert it,
+	//the unique index refuses one of them and it's retried as an update of the inserted position
+	var read struct {
+		Seq int64 `bson:"seq"`
+	}
+	updateOpts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	for retried := false; ; retried = true {
+		err := s.db.Database("messenger").Collection("reads").FindOneAndUpdate(ctx,
+			bson.D{{Key: "chat_id", Value: chatId}, {Key: "username", Value: username}},
+			bson.D{{Key: "$max", Value: bson.D{{Key: "seq", Value: min(seq, chat.LastSeq)}}}},
+			updateOpts,
+		).Decode(&read)
+		if err == nil {
+			return read.Seq, nil
+		}
+		if retried || !mongo.IsDuplicateKeyError(err) {
+			return 0, err
+		}
+	}
+}
+
+// GetReadState returns last read positions of users in a chat by username
+func (s *Storage) GetReadState(ctx context.Context, chatId string) (map[string]int64, error) {
+	//Get reads collection
+	coll := s.db.Database("messenger").Collection("reads")
+
+	//Find read positions of the chat
+	cursor, err := coll.Find(ctx, bson.D{{Key: "chat_id", Value: chatId}})
+	if err != nil {
+		return nil, err
+	}
+
+	//Parse read positions
+	var reads []struct {
+		Username string `bson:"username"`
+		Seq      int64  `bson:"seq"`
+	}
+	if err = cursor.All(ctx, &reads); err != nil {
+		return nil, err
+	}
+	state := make(map[string]int64, len(reads))
+	for _, read := range reads {
+		state[read.Username] = read.Seq
+	}
+	return state, nil
+}
+
+// GetUnreadCounts returns number of unread messages in user chats by chat id.
+// Messages sent by the user and deleted messages are not counted
+func (s *Storage) GetUnreadCounts(ctx context.Context, username string) (map[string]int64, error) {
+	//Get user chats
+	chats, err := s.GetChats(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	//Get read positions of the user
+	cursor, err := s.db.Database("messenger").Collection("reads").Find(ctx, bson.D{{Key: "username", Value: username}})
+	if err != nil {
+		return nil, err
+	}
+	var reads []struct {
+		ChatId string `bson:"chat_id"`
+		Seq    int64  `bson:"seq"`
+	}
+	if err = cursor.All(ctx, &reads); err != nil {
+		return nil, err
+	}
+	lastRead := make(map[string]int64, len(reads))
+	for _, read := range reads {
+		lastRead[read.ChatId] = read.Seq
+	}
+
+	//Count messages after the read position in every chat
+	coll := s.db.Database("messenger").Collection("messages")
+	counts := make(map[string]int64, len(chats))
+	for _, chat := range chats {
+		count, err := coll.CountDocuments(ctx, bson.D{
+			{Key: "chat_id", Value: chat.Id},
+			{Key: "seq", Value: bson.D{{Key: "$gt", Value: lastRead[chat.Id]}}},
+			{Key: "from", Value: bson.D{{Key: "$ne", Value: username}}},
+			{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		counts[chat.Id] = count
+	}
+	return counts, nil
+}
+
+// SetLastSeen saves time when user was last online
+func (s *Storage) SetLastSeen(ctx context.Context, username string, lastSeen int64) error {
+	//Get users collection
+	coll := s.db.Database("messenger").Collection("users")
+
+	//Update last seen time
+	res, err := coll.UpdateOne(ctx,
+		bson.D{{Key: "username", Value: username}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "last_seen", Value: lastSeen}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetLastSeen returns time when users were last online by username. Users that have never been online are omitted
+func (s *Storage) GetLastSeen(ctx context.Context, usernames []string) (map[string]int64, error) {
+	//Get users collection
+	coll := s.db.Database("messenger").Collection("users")
+
+	//Find users with last seen time
+	opts := options.Find().SetProjection(bson.D{{Key: "username", Value: 1}, {Key: "last_seen", Value: 1}})
+	cursor, err := coll.Find(ctx, bson.D{
+		{Key: "username", Value: bson.D{{Key: "$in", Value: usernames}}},
+		{Key: "last_seen", Value: bson.D{{Key: "$exists", Value: true}}},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	//Parse users
+	var users []struct {
+		Username string `bson:"username"`
+		LastSeen int64  `bson:"last_seen"`
+	}
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	lastSeen := make(map[string]int64, len(users))
+	for _, user := range users {
+		lastSeen[user.Username] = user.LastSeen
+	}
+	return lastSeen, nil
 }
@@ -8,6 +8,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -20,6 +21,26 @@ func TestNew(t *testing.T) {
 	assert.NoError(t, storage.db.Disconnect(context.Background()))
 }
 
+func TestMongoStore(t *testing.T) {
+	//Create new mongo client and skip the suite if the server isn't running
+	client, err := createDBConnection()
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, client.Disconnect(context.Background())) }()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Skipf("MongoDB is unreachable: %v", err)
+	}
+
+	runStorerSuite(t, func(t *testing.T) Storer {
+		//Start every test with empty collections
+		storage := New(client)
+		assert.NoError(t, clearStorage(storage.db))
+		assert.NoError(t, storage.CreateIndexes(context.Background()))
+		return storage
+	})
+}
+
 func TestNewUser(t *testing.T) {
 	//Create ne mongo client
 	client, err := createDBConnection()
@@ -164,12 +185,13 @@ func TestSaveMessage(t *testing.T) {
 	chatIdString := chatId.(primitive.ObjectID).Hex()
 
 	//Save message
-	assert.NoError(t, storage.SaveMessage(context.Background(), Message{
+	_, err = storage.SaveMessage(context.Background(), Message{
 		ChatId: chatIdString,
 		From:   "user1",
 		Text:   "Hello World",
 		Time:   1,
-	}))
+	})
+	assert.NoError(t, err)
 	assert.NoError(t, clearStorage(storage.db))
 }
 
@@ -193,12 +215,13 @@ func TestGetMessages(t *testing.T) {
 	chatIdString := chatId.(primitive.ObjectID).Hex()
 
 	//Save message
-	assert.NoError(t, storage.SaveMessage(context.Background(), Message{
+	_, err = storage.SaveMessage(context.Background(), Message{
 		ChatId: chatIdString,
 		From:   "user1",
 		Text:   "Hello World",
 		Time:   1,
-	}))
+	})
+	assert.NoError(t, err)
 
 	//Get message
 	messages, err := storage.GetMessages(context.Background(), chatIdString)
@@ -246,6 +269,69 @@ func TestRemoveUserFromChat(t *testing.T) {
 	assert.NoError(t, clearStorage(storage.db))
 }
 
+func TestWatchMessages(t *testing.T) {
+	//Create new mongo client
+	client, err := createDBConnection()
+	assert.NoError(t, err)
+
+	//Create new storage
+	storage := New(client)
+	assert.NoError(t, clearStorage(storage.db))
+
+	//Create new chat
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	chatIdString := chatId.(primitive.ObjectID).Hex()
+
+	//Watch messages until a change of the kind is handled
+	changes := make(chan MessageChange, 100)
+	watch := func(kind string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		assert.ErrorIs(t, storage.WatchMessages(ctx, "test", func(change MessageChange) {
+			changes <- change
+			if change.Kind == kind {
+				cancel()
+			}
+		}), context.Canceled)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watch(ChangeInsert)
+	}()
+
+	//Save messages until the stream is started and check that new message is streamed
+	assert.Eventually(t, func() bool {
+		_, err := storage.SaveMessage(context.Background(), Message{ChatId: chatIdString, From: "user1", Text: "hello"})
+		assert.NoError(t, err)
+		select {
+		case change := <-changes:
+			return change.Kind == ChangeInsert && change.Message.Text == "hello"
+		case <-time.After(time.Millisecond * 100):
+			return false
+		}
+	}, time.Second*5, time.Millisecond*10)
+	<-done
+
+	//Delete message while the stream is stopped and check that the stream resumes after the last handled change
+	messages, err := storage.GetMessages(context.Background(), chatIdString)
+	assert.NoError(t, err)
+	_, err = storage.DeleteMessage(context.Background(), chatIdString, messages[0].Id, 1)
+	assert.NoError(t, err)
+	for len(changes) > 0 {
+		<-changes
+	}
+	watch(ChangeDelete)
+	var change MessageChange
+	for len(changes) > 0 {
+		change = <-changes
+	}
+	assert.Equal(t, ChangeDelete, change.Kind)
+	assert.Equal(t, messages[0].Id, change.Message.Id)
+	assert.NoError(t, clearStorage(storage.db))
+}
+
 func createDBConnection() (*mongo.Client, error) {
 	//Create storage
 	return mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
@@ -269,5 +355,17 @@ func clearStorage(client *mongo.Client) error {
 	if _, err := coll.DeleteMany(context.Background(), bson.D{}); err != nil {
 		return err
 	}
+
+	//Clear read state
+	coll = client.Database("messenger").Collection("reads")
+	if _, err := coll.DeleteMany(context.Background(), bson.D{}); err != nil {
+		return err
+	}
+
+	//Clear resume tokens of change streams
+	coll = client.Database("messenger").Collection("stream_tokens")
+	if _, err := coll.DeleteMany(context.Background(), bson.D{}); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of message changes
+const (
+	ChangeInsert = "insert"
+	ChangeEdit   = "edit"
+	ChangeDelete = "delete"
+)
+
+// MessageChange is a message saved, edited or deleted by any server instance, see WatchMessages
+type MessageChange struct {
+	//Kind is ChangeInsert, ChangeEdit or ChangeDelete
+	Kind    string
+	Message Message
+}
+
+// codeChangeStreamHistoryLost is returned by the server when the saved resume token is no longer in the oplog
+const codeChangeStreamHistoryLost = 286
+
+// WatchMessages calls handler for every message inserted, edited or deleted in the messages collection
+// until ctx is done or the stream fails. Resume token of every handled change is saved under the name,
+// so the stream with the same name continues after the last handled change when it's restarted.
+// If the stream can't resume because the token has fallen off the oplog the token is deleted,
+// so the restarted stream starts from the current changes.
+// Change streams are available only on replica sets and sharded clusters
+func (s *Storage) WatchMessages(ctx context.Context, name string, handler func(MessageChange)) error {
+	err := s.watchMessages(ctx, name, handler)
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(codeChangeStreamHistoryLost) {
+		tokens := s.db.Database("messenger").Collection("stream_tokens")
+		if _, deleteErr := tokens.DeleteOne(context.WithoutCancel(ctx), bson.D{{Key: "_id", Value: name}}); deleteErr != nil {
+			return errors.Join(err, deleteErr)
+		}
+	}
+	return err
+}
+
+// watchMessages streams message changes starting after the saved resume token, see WatchMessages
+func (s *Storage) watchMessages(ctx context.Context, name string, handler func(MessageChange)) error {
+	//Get collection of resume tokens
+	tokens := s.db.Database("messenger").Collection("stream_tokens")
+
+	//Continue after the saved token if there is one
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	var saved struct {
+		Token bson.Raw `bson:"token"`
+	}
+	if err := tokens.FindOne(ctx, bson.D{{Key: "_id", Value: name}}).Decode(&saved); err == nil {
+		opts.SetStartAfter(saved.Token)
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	//Watch new messages, edits and deletes, updates hiding messages are skipped
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "operationType", Value: "insert"}},
+		bson.D{{Key: "updateDescription.updatedFields.edited_at", Value: bson.D{{Key: "$exists", Value: true}}}},
+		bson.D{{Key: "updateDescription.updatedFields.deleted_at", Value: bson.D{{Key: "$exists", Value: true}}}},
+	}}}}}}
+	stream, err := s.db.Database("messenger").Collection("messages").Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var change struct {
+			OperationType string   `bson:"operationType"`
+			FullDocument  *Message `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+
+		//Document of an update is missing if the message was removed before it was looked up
+		if change.FullDocument != nil {
+			kind := ChangeInsert
+			switch {
+			case change.OperationType == "insert":
+			case change.FullDocument.DeletedAt != 0:
+				kind = ChangeDelete
+			default:
+				kind = ChangeEdit
+			}
+			handler(MessageChange{Kind: kind, Message: *change.FullDocument})
+		}
+
+		//Save resume token of the handled change even if ctx is done meanwhile
+		if _, err := tokens.UpdateOne(context.WithoutCancel(ctx),
+			bson.D{{Key: "_id", Value: name}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "token", Value: stream.ResumeToken()}}}},
+			options.Update().SetUpsert(true),
+		); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return stream.Err()
+}
@@ -0,0 +1,534 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// runStorerSuite runs behavioral tests that every Storer implementation must pass.
+// newStorer must return a new empty storage on every call
+func runStorerSuite(t *testing.T, newStorer func(t *testing.T) Storer) {
+	t.Run("NewUser", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new user
+		assert.NoError(t, storage.NewUser(context.Background(), "testUsername", "testPassword"))
+
+		//Check that the same username can't be registered twice
+		assert.ErrorIs(t, storage.NewUser(context.Background(), "testUsername", "testPassword"), ErrUserExists)
+
+		//Register the same username concurrently and check that only one registration succeeds
+		errs := make(chan error, 10)
+		for range 10 {
+			go func() { errs <- storage.NewUser(context.Background(), "concurrentUsername", "testPassword") }()
+		}
+		registered := 0
+		for range 10 {
+			err := <-errs
+			if err == nil {
+				registered++
+			} else {
+				assert.ErrorIs(t, err, ErrUserExists)
+			}
+		}
+		assert.Equal(t, 1, registered)
+	})
+
+	t.Run("GetUser", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new user
+		assert.NoError(t, storage.NewUser(context.Background(), "testUsername", "testPassword"))
+
+		//Get the user from the storage
+		user, err := storage.GetUser(context.Background(), "testUsername")
+		assert.NoError(t, err)
+
+		//Check that user is the same that we saved
+		assert.Equal(t, "testUsername", user.Username)
+		assert.Equal(t, "testPassword", user.Password)
+		assert.NotEmpty(t, user.Id)
+
+		//Check that missing user returns an error
+		_, err = storage.GetUser(context.Background(), "missingUsername")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("NewChat", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+
+		//Check that chatId is not empty
+		assert.NotEmpty(t, chatId)
+
+		//Check that 2-member chat with the same members is not created twice
+		sameChatId, err := storage.NewChat(context.Background(), []string{"user2", "user1"}, "user2")
+		assert.NoError(t, err)
+		assert.Equal(t, idString(chatId), idString(sameChatId))
+
+		//Check that group chats are always created
+		groupChatId, err := storage.NewChat(context.Background(), []string{"user1", "user2", "user3"}, "user1")
+		assert.NoError(t, err)
+		assert.NotEqual(t, idString(chatId), idString(groupChatId))
+	})
+
+	t.Run("GetChat", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+
+		//Get chat from the storage
+		chat, err := storage.GetChat(context.Background(), idString(chatId))
+		assert.NoError(t, err)
+
+		//Check that we got the same chat that we saved
+		assert.Equal(t, idString(chatId), chat.Id)
+		assert.Equal(t, []string{"user1", "user2"}, chat.Members)
+		assert.Equal(t, "user1", chat.Owner)
+
+		//Check that missing chat returns an error
+		_, err = storage.GetChat(context.Background(), primitive.NewObjectID().Hex())
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("GetChats", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create two chats
+		chatId1, err := storage.NewChat(context.Background(), []string{"user1", "user2", "user3"}, "user1")
+		assert.NoError(t, err)
+		chatId2, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+		_, err = storage.NewChat(context.Background(), []string{"user1", "user3"}, "user1")
+		assert.NoError(t, err)
+
+		//Get chats of the user
+		chats, err := storage.GetChats(context.Background(), "user2")
+		assert.NoError(t, err)
+
+		//Check that received chats are the same chats we saved
+		assert.Equal(t, 2, len(chats))
+		assert.Equal(t, idString(chatId1), chats[0].Id)
+		assert.Equal(t, idString(chatId2), chats[1].Id)
+	})
+
+	t.Run("SaveMessage", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create two chats
+		chatId1, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+		chatId2, err := storage.NewChat(context.Background(), []string{"user1", "user3"}, "user1")
+		assert.NoError(t, err)
+
+		//Save messages to both chats
+		first, err := storage.SaveMessage(context.Background(), Message{ChatId: idString(chatId1), From: "user1", Text: "first", Time: 1})
+		assert.NoError(t, err)
+		second, err := storage.SaveMessage(context.Background(), Message{ChatId: idString(chatId1), From: "user2", Text: "second", Time: 1})
+		assert.NoError(t, err)
+		other, err := storage.SaveMessage(context.Background(), Message{ChatId: idString(chatId2), From: "user1", Text: "other", Time: 1})
+		assert.NoError(t, err)
+
+		//Check that messages got unique ids and sequence numbers grow within a chat
+		assert.NotEmpty(t, first.Id)
+		assert.NotEqual(t, first.Id, second.Id)
+		assert.Equal(t, int64(1), first.Seq)
+		assert.Equal(t, int64(2), second.Seq)
+		assert.Equal(t, int64(1), other.Seq)
+		assert.Equal(t, "first", first.Text)
+
+		//Check that stored messages have the same ids and sequence numbers
+		messages, err := storage.GetMessages(context.Background(), idString(chatId1))
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{*first, *second}, messages)
+
+		//Check that messages can't be saved to a missing chat
+		_, err = storage.SaveMessage(context.Background(), Message{ChatId: primitive.NewObjectID().Hex(), From: "user1", Text: "lost", Time: 1})
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("GetMessages", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+
+		//Save message
+		_, err = storage.SaveMessage(context.Background(), Message{
+			ChatId: idString(chatId),
+			From:   "user1",
+			Text:   "Hello World",
+			Time:   1,
+		})
+		assert.NoError(t, err)
+
+		//Get messages
+		messages, err := storage.GetMessages(context.Background(), idString(chatId))
+		assert.NoError(t, err)
+
+		//Check that received messages is the same as the saved message
+		assert.Equal(t, 1, len(messages))
+		assert.Equal(t, "user1", messages[0].From)
+		assert.Equal(t, "Hello World", messages[0].Text)
+		assert.Equal(t, int64(1), messages[0].Time)
+
+		//Check that messages from other chats are not returned
+		messages, err = storage.GetMessages(context.Background(), primitive.NewObjectID().Hex())
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+	})
+
+	t.Run("GetMessagesSince", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+
+		//Save messages with times out of sequence order
+		for i, text := range []string{"one", "two", "three", "four"} {
+			_, err := storage.SaveMessage(context.Background(), Message{ChatId: idString(chatId), From: "user1", Text: text, Time: int64(10 - i)})
+			assert.NoError(t, err)
+		}
+
+		//Check that messages after the sequence number are returned in sequence order
+		messages, err := storage.GetMessagesSince(context.Background(), idString(chatId), 1, 2)
+		assert.NoError(t, err)
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "two", messages[0].Text)
+		assert.Equal(t, int64(3), messages[1].Seq)
+
+		//Check that nothing is returned when client is up to date
+		messages, err = storage.GetMessagesSince(context.Background(), idString(chatId), 4, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+	})
+
+	t.Run("GetMessagesPage", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+
+		//Save messages, two of them are sent at the same time
+		for i, sentAt := range []int64{1, 2, 2, 3, 4} {
+			_, err = storage.SaveMessage(context.Background(), Message{
+				ChatId: idString(chatId),
+				From:   "user1",
+				Text:   fmt.Sprintf("message %d", i+1),
+				Time:   sentAt,
+			})
+			assert.NoError(t, err)
+		}
+
+		//Get the newest page
+		page, err := storage.GetMessagesPage(context.Background(), idString(chatId), MessageQuery{Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"message 5", "message 4"}, pageTexts(page))
+		assert.NotEmpty(t, page.Before)
+		assert.Empty(t, page.After)
+
+		//Get older page
+		page, err = storage.GetMessagesPage(context.Background(), idString(chatId), MessageQuery{Before: page.Before, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"message 3", "message 2"}, pageTexts(page))
+		assert.NotEmpty(t, page.Before)
+		assert.NotEmpty(t, page.After)
+		middle := page
+
+		//Get the oldest page
+		page, err = storage.GetMessagesPage(context.Background(), idString(chatId), MessageQuery{Before: page.Before, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"message 1"}, pageTexts(page))
+		assert.Empty(t, page.Before)
+
+		//Page forward from the middle page
+		page, err = storage.GetMessagesPage(context.Background(), idString(chatId), MessageQuery{After: middle.After, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"message 5", "message 4"}, pageTexts(page))
+		assert.NotEmpty(t, page.Before)
+		assert.Empty(t, page.After)
+
+		//Page forward with a smaller limit
+		page, err = storage.GetMessagesPage(context.Background(), idString(chatId), MessageQuery{After: middle.After, Limit: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"message 4"}, pageTexts(page))
+		assert.NotEmpty(t, page.After)
+
+		//Check that invalid cursors are refused
+		_, err = storage.GetMessagesPage(context.Background(), idString(chatId), MessageQuery{Before: "invalid"})
+		assert.ErrorIs(t, err, ErrInvalidCursor)
+	})
+
+	t.Run("EditMessage", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat and save a message
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+		msg, err := storage.SaveMessage(context.Background(), Message{ChatId: idString(chatId), From: "user1", Text: "helo", Time: 1})
+		assert.NoError(t, err)
+
+		//Check that new message has no revisions
+		revisions, err := storage.GetRevisions(context.Background(), idString(chatId), msg.Id)
+		assert.NoError(t, err)
+		assert.Empty(t, revisions)
+
+		//Edit message twice
+		edited, err := storage.EditMessage(context.Background(), idString(chatId), msg.Id, "hello", 2)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", edited.Text)
+		assert.Equal(t, int64(2), edited.EditedAt)
+		_, err = storage.EditMessage(context.Background(), idString(chatId), msg.Id, "hello world", 3)
+		assert.NoError(t, err)
+
+		//Check that stored message has the latest text and keeps its id and sequence number
+		stored, err := storage.GetMessage(context.Background(), idString(chatId), msg.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", stored.Text)
+		assert.Equal(t, int64(3), stored.EditedAt)
+		assert.Equal(t, msg.Seq, stored.Seq)
+		assert.Equal(t, int64(1), stored.Time)
+
+		//Check that previous versions are kept
+		revisions, err = storage.GetRevisions(context.Background(), idString(chatId), msg.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, []Revision{{Text: "helo", Time: 1}, {Text: "hello", Time: 2}}, revisions)
+
+		//Check that messages are looked up only in their own chat
+		_, err = storage.GetMessage(context.Background(), primitive.NewObjectID().Hex(), msg.Id)
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = storage.EditMessage(context.Background(), idString(chatId), primitive.NewObjectID().Hex(), "missing", 4)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("DeleteMessage", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat and save an edited message
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+		msg, err := storage.SaveMessage(context.Background(), Message{ChatId: idString(chatId), From: "user1", Text: "secret", Time: 1})
+		assert.NoError(t, err)
+		_, err = storage.EditMessage(context.Background(), idString(chatId), msg.Id, "another secret", 2)
+		assert.NoError(t, err)
+
+		//Delete message for everyone
+		deleted, err := storage.DeleteMessage(context.Background(), idString(chatId), msg.Id, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), deleted.DeletedAt)
+		assert.Empty(t, deleted.Text)
+
+		//Check that tombstone is kept without text and revisions
+		messages, err := storage.GetMessages(context.Background(), idString(chatId))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(messages))
+		assert.Equal(t, msg.Id, messages[0].Id)
+		assert.Empty(t, messages[0].Text)
+		assert.Equal(t, int64(3), messages[0].DeletedAt)
+		revisions, err := storage.GetRevisions(context.Background(), idString(chatId), msg.Id)
+		assert.NoError(t, err)
+		assert.Empty(t, revisions)
+
+		//Check that missing messages can't be deleted
+		_, err = storage.DeleteMessage(context.Background(), idString(chatId), primitive.NewObjectID().Hex(), 3)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("HideMessage", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat and save two messages
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+		first, err := storage.SaveMessage(context.Background(), Message{ChatId: idString(chatId), From: "user1", Text: "first", Time: 1})
+		assert.NoError(t, err)
+		_, err = storage.SaveMessage(context.Background(), Message{ChatId: idString(chatId), From: "user1", Text: "second", Time: 2})
+		assert.NoError(t, err)
+
+		//Hide first message for the second user, hiding twice is allowed
+		assert.NoError(t, storage.HideMessage(context.Background(), idString(chatId), first.Id, "user2"))
+		assert.NoError(t, storage.HideMessage(context.Background(), idString(chatId), first.Id, "user2"))
+
+		//Check that message is hidden only for the second user
+		hidden, err := storage.GetHiddenMessages(context.Background(), idString(chatId), "user2")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{first.Id}, hidden)
+		hidden, err = storage.GetHiddenMessages(context.Background(), idString(chatId), "user1")
+		assert.NoError(t, err)
+		assert.Empty(t, hidden)
+
+		//Check that missing messages can't be hidden
+		assert.ErrorIs(t, storage.HideMessage(context.Background(), idString(chatId), primitive.NewObjectID().Hex(), "user2"), ErrNotFound)
+	})
+
+	t.Run("MarkRead", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create two chats and send messages to the first one
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+		otherId, err := storage.NewChat(context.Background(), []string{"user2", "user3"}, "user2")
+		assert.NoError(t, err)
+		for _, from := range []string{"user1", "user1", "user2", "user1"} {
+			_, err := storage.SaveMessage(context.Background(), Message{ChatId: idString(chatId), From: from, Text: "hi", Time: 1})
+			assert.NoError(t, err)
+		}
+
+		//Check that messages from others are unread
+		counts, err := storage.GetUnreadCounts(context.Background(), "user2")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{idString(chatId): 3, idString(otherId): 0}, counts)
+
+		//Read first two messages and check that position can't move back or past the last message
+		read, err := storage.MarkRead(context.Background(), idString(chatId), "user2", 2)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), read)
+		read, err = storage.MarkRead(context.Background(), idString(chatId), "user2", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), read)
+		read, err = storage.MarkRead(context.Background(), idString(chatId), "user1", 100)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), read)
+
+		//Check read state and unread counts
+		state, err := storage.GetReadState(context.Background(), idString(chatId))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"user1": 4, "user2": 2}, state)
+		counts, err = storage.GetUnreadCounts(context.Background(), "user2")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), counts[idString(chatId)])
+
+		//Mark messages as read concurrently and check that the user has one read position
+		for range 4 {
+			_, err := storage.SaveMessage(context.Background(), Message{ChatId: idString(otherId), From: "user2", Text: "hi", Time: 1})
+			assert.NoError(t, err)
+		}
+		var wg sync.WaitGroup
+		for seq := int64(1); seq <= 4; seq++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := storage.MarkRead(context.Background(), idString(otherId), "user3", seq)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		state, err = storage.GetReadState(context.Background(), idString(otherId))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"user3": 4}, state)
+
+		//Check that missing chats are refused
+		_, err = storage.MarkRead(context.Background(), primitive.NewObjectID().Hex(), "user2", 1)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("LastSeen", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create two users
+		assert.NoError(t, storage.NewUser(context.Background(), "user1", "password"))
+		assert.NoError(t, storage.NewUser(context.Background(), "user2", "password"))
+
+		//Save last seen time of one user and overwrite it
+		assert.NoError(t, storage.SetLastSeen(context.Background(), "user1", 10))
+		assert.NoError(t, storage.SetLastSeen(context.Background(), "user1", 20))
+
+		//Check that users that have never been online are omitted
+		lastSeen, err := storage.GetLastSeen(context.Background(), []string{"user1", "user2", "missing"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"user1": 20}, lastSeen)
+
+		//Check that last seen time of missing users can't be saved
+		assert.ErrorIs(t, storage.SetLastSeen(context.Background(), "missing", 10), ErrNotFound)
+	})
+
+	t.Run("RemoveUserFromChat", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+
+		//Remove user from chat
+		assert.NoError(t, storage.RemoveUserFromChat(context.Background(), "user1", idString(chatId)))
+
+		//Check that user has been removed
+		chat, err := storage.GetChat(context.Background(), idString(chatId))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user2"}, chat.Members)
+		assert.Equal(t, "user1", chat.Owner)
+
+		//Check that chat is no longer listed for the removed user
+		chats, err := storage.GetChats(context.Background(), "user1")
+		assert.NoError(t, err)
+		assert.Empty(t, chats)
+
+		//Check that users can't be removed from a missing chat
+		assert.ErrorIs(t, storage.RemoveUserFromChat(context.Background(), "user2", primitive.NewObjectID().Hex()), ErrNotFound)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		storage := newStorer(t)
+
+		//Create new chat
+		chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+		assert.NoError(t, err)
+
+		//Save messages from several goroutines
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := storage.SaveMessage(context.Background(), Message{
+					ChatId: idString(chatId),
+					From:   "user1",
+					Text:   fmt.Sprintf("message %d", i),
+					Time:   int64(i),
+				})
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+
+		//Check that no message has been lost and every message got its own sequence number
+		messages, err := storage.GetMessages(context.Background(), idString(chatId))
+		assert.NoError(t, err)
+		assert.Equal(t, 20, len(messages))
+		seqs := make(map[int64]bool)
+		for _, msg := range messages {
+			seqs[msg.Seq] = true
+		}
+		assert.Equal(t, 20, len(seqs))
+	})
+}
+
+// pageTexts returns texts of the page messages
+func pageTexts(page *MessagePage) []string {
+	texts := make([]string, 0, len(page.Messages))
+	for _, msg := range page.Messages {
+		texts = append(texts, msg.Text)
+	}
+	return texts
+}
+
+// idString converts chat id returned by NewChat into a string
+func idString(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
+}
@@ -1,19 +1,15 @@
 package token
 
-import (
-	"github.com/golang-jwt/jwt/v5"
-)
-
 type MockManager struct{}
 
 func NewMockManager() *MockManager {
 	return &MockManager{}
 }
 
-func (manager *MockManager) NewToken(userId string) (string, error) {
+func (manager *MockManager) NewToken(userId, device string) (string, error) {
 	return "", nil
 }
 
-func (manager *MockManager) Verify(tokenString string) (*jwt.RegisteredClaims, error) {
-	return &jwt.RegisteredClaims{}, nil
+func (manager *MockManager) Verify(tokenString string) (*Claims, error) {
+	return &Claims{}, nil
 }
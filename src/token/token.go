@@ -12,8 +12,14 @@ const (
 )
 
 type Manager interface {
-	NewToken(userId string) (string, error)
-	Verify(tokenString string) (*jwt.RegisteredClaims, error)
+	NewToken(userId, device string) (string, error)
+	Verify(tokenString string) (*Claims, error)
+}
+
+// Claims is the token payload. Device identifies the session so every device of a user gets its own token
+type Claims struct {
+	jwt.RegisteredClaims
+	Device string `json:"device,omitempty"`
 }
 
 type JWTManager struct {
@@ -27,12 +33,15 @@ func New(signingKey string) *JWTManager {
 	}
 }
 
-// NewToken generates a JWT token using SHA512 algorithm
-func (manager *JWTManager) NewToken(userId string) (string, error) {
+// NewToken generates a JWT token for the user's device using SHA512 algorithm
+func (manager *JWTManager) NewToken(userId, device string) (string, error) {
 	//Define the payload
-	claims := jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenLiveSpan)),
-		Subject:   userId,
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenLiveSpan)),
+			Subject:   userId,
+		},
+		Device: device,
 	}
 
 	//Create token
@@ -45,9 +54,9 @@ func (manager *JWTManager) NewToken(userId string) (string, error) {
 }
 
 // Verify verifies JWT token and returns token's payload
-func (manager *JWTManager) Verify(tokenString string) (*jwt.RegisteredClaims, error) {
+func (manager *JWTManager) Verify(tokenString string) (*Claims, error) {
 	//Parse token
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		//Check signing method
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("invalid signing method")
@@ -60,7 +69,7 @@ func (manager *JWTManager) Verify(tokenString string) (*jwt.RegisteredClaims, er
 	}
 
 	//Get token claims
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
+	claims, ok := token.Claims.(*Claims)
 	if !ok {
 		return nil, fmt.Errorf("invalid token claims")
 	}
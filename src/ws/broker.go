@@ -0,0 +1,187 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dafraer/messenger/src/broker"
+)
+
+// Routes of envelopes passed between managers
+const (
+	//routeMessage delivers a new message to the chat members, see deliver
+	routeMessage = "message"
+	//routeChat sends event to clients of the chats
+	routeChat = "chat"
+	//routeUser sends event to clients of the user subscribed to the chat
+	routeUser = "user"
+	//routeMembers caches members of a new chat and subscribes their clients, see AddChatClients
+	routeMembers = "members"
+	//routeRemoveMember unsubscribes a removed member, see RemoveChatMember
+	routeRemoveMember = "remove_member"
+	//routePresence tells that the user came online or went offline on the manager, see notifyPresence
+	routePresence = "presence"
+	//routePresenceSync asks other managers to announce their online users, see SetBroker
+	routePresenceSync = "presence_sync"
+)
+
+// envelope is routed by the manager that created it and published to the broker
+// so other managers route it to their clients too
+type envelope struct {
+	//Origin is id of the manager that published the envelope, managers skip their own envelopes
+	Origin  string   `json:"origin"`
+	Route   string   `json:"route"`
+	ChatIds []string `json:"chat_ids"`
+	//Username is the sender of a new message, the user whose clients are skipped by routeChat,
+	//the recipient of routeUser or the removed member
+	Username string `json:"username,omitempty"`
+	//Device is the sender's device that doesn't get a new message queued
+	Device  string   `json:"device,omitempty"`
+	Members []string `json:"members,omitempty"`
+	Event   Event    `json:"event"`
+}
+
+// SetBroker makes the manager publish events to the broker and route events published by other managers
+// connected to it, so clients connected to different server instances can talk to each other.
+// Managers share which users are online, so users are online while they are connected to any instance.
+// Users of an instance that stops without disconnecting its clients stay online until they connect again.
+// Device delivery state still covers only clients of this manager
+func (m *Manager) SetBroker(ctx context.Context, b broker.Broker) error {
+	if err := b.Subscribe(ctx, m.receive); err != nil {
+		return err
+	}
+	m.broker = b
+
+	//Learn users who are online on other managers
+	return m.publish(envelope{Route: routePresenceSync})
+}
+
+// dispatch routes envelope to clients of this manager and publishes it to other managers
+func (m *Manager) dispatch(env envelope, sender *Client) error {
+	if err := m.route(env, sender); err != nil {
+		return err
+	}
+	return m.publish(env)
+}
+
+// publish publishes envelope to other managers
+func (m *Manager) publish(env envelope) error {
+	if m.broker == nil {
+		return nil
+	}
+
+	//Local clients have the event already, so failed publish is only logged
+	env.Origin = m.id
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	if err := m.broker.Publish(context.TODO(), data); err != nil {
+		m.logger.Errorw("Error publishing event", "error", err)
+	}
+	return nil
+}
+
+// receive routes envelope published by another manager
+func (m *Manager) receive(data []byte) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		m.logger.Errorw("Error decoding published event", "error", err)
+		return
+	}
+	if env.Origin == m.id {
+		return
+	}
+
+	//Announce online users from a separate goroutine since the broker may not let the handler publish
+	if env.Route == routePresenceSync {
+		go m.announcePresence()
+		return
+	}
+
+	//Load members of the chat so the message is queued for their devices
+	if env.Route == routeMessage {
+		for _, chatId := range env.ChatIds {
+			if _, err := m.isMember(context.TODO(), chatId, env.Username); err != nil {
+				m.logger.Errorw("Error loading chat members", "error", err)
+			}
+		}
+	}
+
+	if err := m.route(env, nil); err != nil {
+		m.logger.Errorw("Error routing published event", "error", err)
+	}
+}
+
+// route sends envelope to clients of this manager except the sender
+func (m *Manager) route(env envelope, sender *Client) error {
+	switch env.Route {
+	case routeMessage:
+		var message Message
+		if err := decodePayload(env.Event, &message); err != nil {
+			return err
+		}
+		m.deliverLocal(message, env.Event, deviceKey{username: env.Username, device: env.Device}, sender)
+	case routeChat:
+		m.sendLocal(env.ChatIds, env.Event, func(client *Client) bool {
+			return client != sender && (env.Username == "" || client.username != env.Username)
+		})
+	case routeUser:
+		m.sendLocal(env.ChatIds, env.Event, func(client *Client) bool {
+			return client.username == env.Username
+		})
+	case routeMembers:
+		for _, chatId := range env.ChatIds {
+			m.addChatClients(chatId, env.Members)
+		}
+	case routeRemoveMember:
+		for _, chatId := range env.ChatIds {
+			m.removeChatMember(chatId, env.Username)
+		}
+	case routePresence:
+		var presence Presence
+		if err := decodePayload(env.Event, &presence); err != nil {
+			return err
+		}
+		if m.updatePresence(env.Origin, presence) {
+			m.sendLocal(env.ChatIds, env.Event, func(client *Client) bool {
+				return client.username != env.Username
+			})
+		}
+	default:
+		return fmt.Errorf("unknown route %q", env.Route)
+	}
+	return nil
+}
+
+// sendLocal sends event once to every client of the chats accepted by the filter
+func (m *Manager) sendLocal(chatIds []string, event Event, accept func(client *Client) bool) {
+	recipients := make(map[*Client]bool)
+	for _, chatId := range chatIds {
+		h := m.hubs.lookup(chatId)
+		if h == nil {
+			continue
+		}
+		for _, client := range h.snapshot() {
+			if accept(client) {
+				recipients[client] = true
+			}
+		}
+	}
+
+	for client := range recipients {
+		client.send(event)
+	}
+}
+
+// newId returns random id of a manager or a client
+func newId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,108 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dafraer/messenger/src/broker"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBroker(t *testing.T) {
+	//Create two managers sharing storage and broker as two server instances would
+	m1, storage := newTestManager(t)
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	m2 := NewManager(logger.Sugar(), storage)
+	b := broker.NewMemoryBroker()
+	for _, m := range []*Manager{m1, m2} {
+		assert.NoError(t, m.SetBroker(context.Background(), b))
+	}
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Connect members to different managers
+	sender, receiver := newTestDevice(t, m1, "user1", "laptop"), newTestDevice(t, m2, "user2", "phone")
+
+	//Check that the sender is notified that the receiver came online on the other manager
+	event := <-sender.writer
+	assert.Equal(t, Presence{Username: "user2", Online: true}, presencePayload(t, event))
+
+	//Check that message sent through the first manager reaches the client of the second one
+	m1.handleEvent(context.Background(), sender, testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	assert.Equal(t, EventAck, (<-sender.writer).Type)
+	event = <-receiver.writer
+	assert.Equal(t, EventMessage, event.Type)
+	var msg Message
+	assert.NoError(t, json.Unmarshal(event.Payload, &msg))
+	assert.Equal(t, "hello", msg.Text)
+	assert.Empty(t, sender.writer)
+
+	//Check that the second manager queues the message until its device acknowledges it
+	assert.Equal(t, []DeviceState{{Device: "phone", Online: true, Pending: 1, Delivered: map[string]int64{}}}, m2.Devices("user2"))
+	m2.handleEvent(context.Background(), receiver, testEvent(t, EventAck, "", Ack{Id: msg.Id}))
+	assert.Equal(t, []DeviceState{{Device: "phone", Online: true, Delivered: map[string]int64{chatIdHex(chatId): 1}}}, m2.Devices("user2"))
+
+	//Check that edits are broadcast between managers
+	_, err = m1.EditMessage(context.Background(), "user1", chatIdHex(chatId), msg.Id, "edited")
+	assert.NoError(t, err)
+	assert.Equal(t, EventEdit, (<-receiver.writer).Type)
+
+	//Check that members removed through one manager are unsubscribed on the other one
+	m1.RemoveChatMember(chatIdHex(chatId), "user2")
+	assert.Empty(t, receiver.hubs)
+
+	//Check that managers ignore their own envelopes
+	m1.receive([]byte(`{"origin":"` + m1.id + `","route":"unknown"}`))
+}
+
+func TestBrokerPresence(t *testing.T) {
+	//Create two managers sharing storage and broker
+	m1, storage := newTestManager(t)
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	m2 := NewManager(logger.Sugar(), storage)
+	b := broker.NewMemoryBroker()
+	for _, m := range []*Manager{m1, m2} {
+		assert.NoError(t, m.SetBroker(context.Background(), b))
+	}
+	_, err = storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Connect the watcher to the first manager and the user to both of them
+	watcher := newTestClient(t, m1, "user1")
+	laptop, phone := newTestDevice(t, m1, "user2", "laptop"), newTestDevice(t, m2, "user2", "phone")
+	assert.Empty(t, watcher.writer)
+
+	//Check that the user is online on a manager without its clients
+	presence, err := m2.Presence(context.Background(), "user2", []string{"user1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Presence{{Username: "user1", Online: true}}, presence)
+
+	//Check that a manager connected later learns online users of the others
+	m3 := NewManager(logger.Sugar(), storage)
+	assert.NoError(t, m3.SetBroker(context.Background(), b))
+	assert.Eventually(t, func() bool {
+		presence, err := m3.Presence(context.Background(), "user1", []string{"user2"})
+		return err == nil && presence[0].Online
+	}, time.Second, 10*time.Millisecond)
+
+	//Check that disconnecting from one manager doesn't make the user offline while connected to another one
+	assert.NoError(t, m1.RemoveClient(context.Background(), laptop))
+	assert.Empty(t, watcher.writer)
+	presence, err = m1.Presence(context.Background(), "user1", []string{"user2"})
+	assert.NoError(t, err)
+	assert.True(t, presence[0].Online)
+
+	//Check that the user goes offline when the last client disconnects
+	assert.NoError(t, m2.RemoveClient(context.Background(), phone))
+	offline := presencePayload(t, <-watcher.writer)
+	assert.Equal(t, "user2", offline.Username)
+	assert.False(t, offline.Online)
+	presence, err = m3.Presence(context.Background(), "user1", []string{"user2"})
+	assert.NoError(t, err)
+	assert.False(t, presence[0].Online)
+}
@@ -0,0 +1,96 @@
+package ws
+
+import (
+	"context"
+	"slices"
+
+	"github.com/dafraer/messenger/src/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChatSummary is a chat with the number of messages the user hasn't read
+type ChatSummary struct {
+	store.Chat
+	Unread int64 `json:"unread"`
+}
+
+// Chats returns chats of the user with unread message counts
+func (m *Manager) Chats(ctx context.Context, username string) ([]ChatSummary, error) {
+	chats, err := m.store.GetChats(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := m.store.GetUnreadCounts(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ChatSummary, 0, len(chats))
+	for _, chat := range chats {
+		result = append(result, ChatSummary{Chat: chat, Unread: unread[chat.Id]})
+	}
+	return result, nil
+}
+
+// CreateChat creates a chat owned by the user and subscribes connected clients of its members.
+// It returns id of the new chat
+func (m *Manager) CreateChat(ctx context.Context, owner string, members []string) (any, error) {
+	id, err := m.store.NewChat(ctx, members, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	//Register new chat so connected clients receive messages immediately
+	if oid, ok := id.(primitive.ObjectID); ok {
+		m.AddChatClients(oid.Hex(), members)
+	}
+	return id, nil
+}
+
+// History returns the whole history of the chat without messages the user has hidden
+func (m *Manager) History(ctx context.Context, username, chatId string) ([]store.Message, error) {
+	hidden, err := m.hiddenMessages(ctx, username, chatId)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := m.store.GetMessages(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	return visibleMessages(messages, hidden), nil
+}
+
+// HistoryPage returns a page of chat messages sorted newest first without messages the user has hidden.
+// Hidden messages are dropped after paging so pages may be shorter than the limit
+func (m *Manager) HistoryPage(ctx context.Context, username, chatId string, query store.MessageQuery) (*store.MessagePage, error) {
+	hidden, err := m.hiddenMessages(ctx, username, chatId)
+	if err != nil {
+		return nil, err
+	}
+	page, err := m.store.GetMessagesPage(ctx, chatId, query)
+	if err != nil {
+		return nil, err
+	}
+	page.Messages = visibleMessages(page.Messages, hidden)
+	return page, nil
+}
+
+// hiddenMessages checks that user is a member of the chat and returns ids of messages the user has hidden.
+// Membership is checked in the storage, so users removed from the chat can't read its history from a stale cache
+func (m *Manager) hiddenMessages(ctx context.Context, username, chatId string) ([]string, error) {
+	member, err := m.isMemberFresh(ctx, chatId, username)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, ErrForbidden
+	}
+	return m.store.GetHiddenMessages(ctx, chatId, username)
+}
+
+// visibleMessages removes hidden messages from the list
+func visibleMessages(messages []store.Message, hidden []string) []store.Message {
+	return slices.DeleteFunc(messages, func(msg store.Message) bool {
+		return slices.Contains(hidden, msg.Id)
+	})
+}
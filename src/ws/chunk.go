@@ -0,0 +1,164 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Default size limits of events read from clients
+const (
+	//DefaultMaxFrameSize is the default maximum size of a single frame
+	DefaultMaxFrameSize = 4 << 10
+	//DefaultMaxMessageSize is the default maximum size of an event reassembled from chunks
+	DefaultMaxMessageSize = 64 << 10
+)
+
+// TooLargeError is returned when a frame or an event reassembled from chunks exceeds its size limit.
+// The event is refused but the connection stays open
+type TooLargeError struct {
+	//Limit is the size limit in bytes
+	Limit int
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("event exceeds the limit of %d bytes", e.Limit)
+}
+
+// frameTooBigError is returned when a frame exceeds MaxMessageSize, such frames close the connection
+type frameTooBigError struct {
+	limit int
+}
+
+func (e *frameTooBigError) Error() string {
+	return fmt.Sprintf("frame exceeds the limit of %d bytes", e.limit)
+}
+
+// Chunk is the payload of chunk events. Events larger than MaxFrameSize are sent as json split into chunks
+// that share the chunk event id and are sent in order. The last chunk completes the event and it is handled
+// as if it was sent in a single frame
+type Chunk struct {
+	//Index of the chunk starting from 0
+	Index int `json:"index"`
+	//Last is set on the last chunk of the event
+	Last bool `json:"last,omitempty"`
+	//Data is the next part of the json encoded event
+	Data string `json:"data"`
+}
+
+// chunkBuffer stores events the client is sending in chunks by chunk event id
+type chunkBuffer struct {
+	mu     sync.Mutex
+	events map[string]*partialEvent
+	//size is the total size of buffered chunks, it's limited by MaxMessageSize
+	size int
+}
+
+// partialEvent is an event whose last chunk hasn't been received yet
+type partialEvent struct {
+	next int
+	data []byte
+}
+
+// add appends chunk to the event and returns the event once its last chunk is added. Events with a chunk
+// out of order or exceeding the limit are dropped
+func (b *chunkBuffer) add(id string, chunk Chunk, limit int) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.events == nil {
+		b.events = make(map[string]*partialEvent)
+	}
+	event, ok := b.events[id]
+	if !ok {
+		event = &partialEvent{}
+	}
+
+	//Refuse chunks out of order
+	if chunk.Index != event.next {
+		b.drop(id)
+		return nil, fmt.Errorf("%w: chunk %d, expected %d", ErrBadRequest, chunk.Index, event.next)
+	}
+
+	//Refuse events exceeding the limit, buffered chunks of all events count towards it
+	if b.size+len(chunk.Data) > limit {
+		b.drop(id)
+		return nil, &TooLargeError{Limit: limit}
+	}
+	event.data = append(event.data, chunk.Data...)
+	event.next++
+	b.size += len(chunk.Data)
+	b.events[id] = event
+
+	if !chunk.Last {
+		return nil, nil
+	}
+	b.drop(id)
+	return event.data, nil
+}
+
+// drop removes the event from the buffer. Must be called with mu held
+func (b *chunkBuffer) drop(id string) {
+	if event, ok := b.events[id]; ok {
+		b.size -= len(event.data)
+		delete(b.events, id)
+	}
+}
+
+// handleChunk buffers a chunk and handles the event once all its chunks are received
+func (m *Manager) handleChunk(ctx context.Context, c *Client, event Event) error {
+	var chunk Chunk
+	if err := decodePayload(event, &chunk); err != nil {
+		return err
+	}
+	if event.Id == "" {
+		return fmt.Errorf("%w: chunk event id is required", ErrBadRequest)
+	}
+
+	data, err := c.chunks.add(event.Id, chunk, m.MaxMessageSize)
+	if err != nil || data == nil {
+		return err
+	}
+
+	//Decode the reassembled event, chunks can't be nested
+	reassembled, err := decodeEvent(data)
+	if err != nil {
+		return err
+	}
+	if reassembled.Type == EventChunk {
+		return fmt.Errorf("%w: chunks can't be nested", ErrBadRequest)
+	}
+	m.handleEvent(ctx, c, reassembled)
+	return nil
+}
+
+// readFrame reads the next frame from the websocket connection. Frames larger than MaxFrameSize
+// are skipped and TooLargeError is returned. Frames larger than any event aren't read to the end,
+// frameTooBigError is returned for them and the connection is closed, see ReadMessages
+func (c *Client) readFrame() ([]byte, error) {
+	_, reader, err := c.connection.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	//Read one byte over the limit to find out whether the frame exceeds it
+	limit := c.manager.MaxFrameSize
+	data, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		//Skip the rest of the frame so the next one can be read, reading one byte over the message limit
+		maxSize := max(limit, c.manager.MaxMessageSize)
+		skipped, err := io.Copy(io.Discard, io.LimitReader(reader, int64(maxSize-len(data))+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data)+int(skipped) > maxSize {
+			return nil, &frameTooBigError{limit: maxSize}
+		}
+		return nil, &TooLargeError{Limit: limit}
+	}
+	return data, nil
+}
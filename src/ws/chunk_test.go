@@ -0,0 +1,108 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunks(t *testing.T) {
+	//Create manager with small limits
+	m, storage := newTestManager(t)
+	m.MaxFrameSize = 64
+	m.MaxMessageSize = 256
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	sender, receiver := newTestClient(t, m, "user1"), newTestClient(t, m, "user2")
+
+	//Split a message larger than a frame into chunks
+	text := strings.Repeat("a", 100)
+	data, err := json.Marshal(testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: text}))
+	assert.NoError(t, err)
+	for i := 0; i*50 < len(data); i++ {
+		end := min((i+1)*50, len(data))
+		m.handleEvent(context.Background(), sender, testEvent(t, EventChunk, "c1", Chunk{Index: i, Last: end == len(data), Data: string(data[i*50 : end])}))
+	}
+
+	//Check that the reassembled message is delivered and acknowledged with its own id
+	event := <-receiver.writer
+	assert.Equal(t, EventMessage, event.Type)
+	var msg Message
+	assert.NoError(t, json.Unmarshal(event.Payload, &msg))
+	assert.Equal(t, text, msg.Text)
+	event = <-sender.writer
+	assert.Equal(t, EventAck, event.Type)
+	assert.Equal(t, "1", event.Id)
+	assert.Empty(t, sender.chunks.events)
+
+	//Check that chunks out of order are refused
+	m.handleEvent(context.Background(), sender, testEvent(t, EventChunk, "c2", Chunk{Index: 1, Data: "{}"}))
+	assertErrorEvent(t, <-sender.writer, "c2", CodeBadRequest)
+
+	//Check that events exceeding the message limit are refused and dropped
+	chunk := Chunk{Data: strings.Repeat("a", 200)}
+	m.handleEvent(context.Background(), sender, testEvent(t, EventChunk, "c3", chunk))
+	chunk.Index = 1
+	m.handleEvent(context.Background(), sender, testEvent(t, EventChunk, "c3", chunk))
+	event = <-sender.writer
+	assertErrorEvent(t, event, "c3", CodeTooLarge)
+	var payload ErrorPayload
+	assert.NoError(t, json.Unmarshal(event.Payload, &payload))
+	assert.Equal(t, 256, payload.Limit)
+	assert.Zero(t, sender.chunks.size)
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	//Create manager with small frame and message limits
+	m, storage := newTestManager(t)
+	m.MaxFrameSize = 128
+	m.MaxMessageSize = 512
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Serve websocket connections of user1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := m.WSUpgrader.Upgrade(w, r, nil)
+		assert.NoError(t, err)
+		client := NewClient(conn, m, "user1", "")
+		assert.NoError(t, m.AddClient(context.Background(), client))
+		go client.ReadMessages(context.Background())
+		go client.WriteMessages(context.Background())
+	}))
+	defer srv.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{SubprotocolJSON}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	var event Event
+	assert.NoError(t, conn.ReadJSON(&event))
+	assert.Equal(t, EventHello, event.Type)
+
+	//Send a frame over the limit and check that it's refused with an error
+	assert.NoError(t, conn.WriteJSON(testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: strings.Repeat("a", 200)})))
+	assert.NoError(t, conn.ReadJSON(&event))
+	assert.Equal(t, EventError, event.Type)
+	var payload ErrorPayload
+	assert.NoError(t, json.Unmarshal(event.Payload, &payload))
+	assert.Equal(t, CodeTooLarge, payload.Code)
+	assert.Equal(t, 128, payload.Limit)
+
+	//Check that the connection is still open
+	assert.NoError(t, conn.WriteJSON(testEvent(t, EventMessage, "2", Message{ChatId: chatIdHex(chatId), Text: "hi"})))
+	assert.NoError(t, conn.ReadJSON(&event))
+	assert.Equal(t, EventAck, event.Type)
+	assert.Equal(t, "2", event.Id)
+
+	//Check that a frame over the message limit closes the connection
+	assert.NoError(t, conn.WriteJSON(testEvent(t, EventMessage, "3", Message{ChatId: chatIdHex(chatId), Text: strings.Repeat("a", 1000)})))
+	err = conn.ReadJSON(&event)
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig))
+	assert.Contains(t, err.Error(), "frame exceeds the limit of 512 bytes")
+}
@@ -2,10 +2,11 @@ package ws
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"github.com/dafraer/messenger/src/store"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,32 +16,97 @@ import (
 const (
 	pongWait     = time.Second * 10
 	pingInterval = (pongWait * 9) / 10
+	closeWait    = time.Second
 )
 
-// Message struct is the message that we receive over websocket
+// Message struct is the payload of message, edit, delete and hide events
 type Message struct {
+	//Id and Seq are assigned by the server when the message is saved
+	Id     string `json:"id,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
 	From   string `json:"from"`
 	ChatId string `json:"chat_id"`
 	Text   string `json:"text"`
+	//Unix utc time
+	Time int64 `json:"time,omitempty"`
+	//Unix utc time of the last edit
+	EditedAt int64 `json:"edited_at,omitempty"`
+	//Unix utc time when message was deleted for everyone
+	DeletedAt int64 `json:"deleted_at,omitempty"`
 }
 
-// Client is a websocket client
+// newMessage converts stored message to the message sent over websocket
+func newMessage(msg *store.Message) Message {
+	return Message{
+		Id:        msg.Id,
+		Seq:       msg.Seq,
+		From:      msg.From,
+		ChatId:    msg.ChatId,
+		Text:      msg.Text,
+		Time:      msg.Time,
+		EditedAt:  msg.EditedAt,
+		DeletedAt: msg.DeletedAt,
+	}
+}
+
+// Client is a connection of a user. Manager routes events to clients regardless of their transport
 type Client struct {
-	username   string
+	//id identifies the connection, clients of transports that receive events on separate requests send it with them
+	id       string
+	username string
+	//device identifies the user's device so messages it hasn't acknowledged can be redelivered on reconnect
+	device string
+	//connection is the websocket connection, it's nil for other transports
 	connection *websocket.Conn
-	manager    *Manager
-	//writer is a channel over which we send messages
-	writer chan Message
+	//codec decodes events read from the websocket connection
+	codec Codec
+	//version is the protocol version negotiated by the client, it's 0 for websocket clients of the legacy protocol
+	version int
+	//accepts stores event types the client handles, all events are sent if it's nil, see handleHello
+	accepts atomic.Pointer[map[string]bool]
+	//transport writes events to the connection
+	transport Transport
+	//done is closed when the client is removed from the manager
+	done chan struct{}
+	//poll is the state of long-poll clients, it's nil for other transports
+	poll    *pollState
+	manager *Manager
+	//writer is a bounded queue of events to be written to the connection, see send
+	writer chan Event
+	//replay stores missed and unacknowledged events written before any other events
+	replay []pendingEvent
 	logger *zap.SugaredLogger
+	//closing is set when a slow or abusive client is being disconnected
+	closing atomic.Bool
+	//violations counts messages in a row refused by rate limits, see limit
+	violations atomic.Int32
+	//hubs stores hubs of the chats the client is subscribed to by chat id, see subscribe
+	hubs   map[string]*hub
+	hubsMu sync.Mutex
+	//removed is set when the client is removed from the manager
+	removed bool
+	//chunks stores events the client is sending in chunks, see handleChunk
+	chunks chunkBuffer
 }
 
-// NewClient creates new websocket client
-func NewClient(conn *websocket.Conn, manager *Manager, username string) *Client {
+// NewClient creates new websocket client. Events are encoded by the codec of the negotiated subprotocol
+func NewClient(conn *websocket.Conn, manager *Manager, username, device string) *Client {
+	codec := codecFor(conn.Subprotocol())
+	version := ProtocolVersion
+	if _, ok := codec.(legacyCodec); ok {
+		version = 0
+	}
 	return &Client{
+		id:         newId(),
 		username:   username,
+		device:     device,
 		connection: conn,
+		codec:      codec,
+		version:    version,
+		transport:  wsTransport{conn: conn, codec: codec},
+		done:       make(chan struct{}),
 		manager:    manager,
-		writer:     make(chan Message),
+		writer:     make(chan Event, manager.SendBuffer),
 		logger:     manager.logger,
 	}
 }
@@ -54,9 +120,6 @@ func (c *Client) ReadMessages(ctx context.Context) {
 		}
 	}()
 
-	//Set message size limit to 512 bytes
-	c.connection.SetReadLimit(512)
-
 	//Configure wait time for pong responses
 	if err := c.connection.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 		c.logger.Errorw("Error setting pong wait time", "error", err)
@@ -74,8 +137,23 @@ func (c *Client) ReadMessages(ctx context.Context) {
 
 	//Infinite loop in which we read messages from the websocket connection
 	for {
-		//Read message from websocket connection
-		_, payload, err := c.connection.ReadMessage()
+		//Read message from websocket connection. Frames that are too large are refused without closing the connection
+		payload, err := c.readFrame()
+		var tooLarge *TooLargeError
+		if errors.As(err, &tooLarge) {
+			c.send(newErrorEvent("", err))
+			continue
+		}
+
+		//Frames larger than any event close the connection with the reason, legacy clients get no error events
+		var tooBig *frameTooBigError
+		if errors.As(err, &tooBig) {
+			message := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, tooBig.Error())
+			if err := c.connection.WriteControl(websocket.CloseMessage, message, time.Now().Add(closeWait)); err != nil {
+				c.logger.Errorw("Error writing close message", "error", err)
+			}
+			return
+		}
 		if err != nil {
 			if !websocket.IsCloseError(err,
 				websocket.CloseNormalClosure,
@@ -88,84 +166,87 @@ func (c *Client) ReadMessages(ctx context.Context) {
 			return
 		}
 
-		//Unmarshal message into message struct
-		var request Message
-		if err := json.Unmarshal(payload, &request); err != nil {
-			c.logger.Errorw("Error unmarshalling event", "error", err)
+		//Decode event and reply with an error if it's malformed
+		event, err := c.codec.Decode(payload)
+		if err != nil {
+			c.send(newErrorEvent(event.Id, err))
 			continue
 		}
 
-		//Set message author to the actual client to prevent impersonation
-		request.From = c.username
+		//Route event to its handler
+		c.manager.handleEvent(context.TODO(), c, event)
+	}
+}
 
-		//Snapshot recipients under read lock to avoid data race and prevent
-		//blocking channel sends while holding the lock
-		c.manager.mu.RLock()
-		recipients := make([]*Client, len(c.manager.chats[request.ChatId]))
-		copy(recipients, c.manager.chats[request.ChatId])
-		c.manager.mu.RUnlock()
+// deviceKey returns key of the client's device
+func (c *Client) deviceKey() deviceKey {
+	return deviceKey{username: c.username, device: c.device}
+}
 
-		//Iterate through chat members and send message
-		for _, client := range recipients {
-			if client != c && client != nil {
-				client.writer <- request
-			}
+// WriteMessages is run in a separate goroutine and is used to write messages over websocket connection
+func (c *Client) WriteMessages(ctx context.Context) {
+	//Gracefully remove the client
+	defer func() {
+		if err := c.manager.RemoveClient(context.Background(), c); err != nil {
+			c.logger.Errorw("error removing client", "error", err)
 		}
+	}()
 
-		//Save message to the database
-		if err := c.manager.store.SaveMessage(context.TODO(), store.Message{ChatId: request.ChatId, From: c.username, Text: request.Text, Time: time.Now().UTC().Unix()}); err != nil {
-			c.logger.Errorw("Error saving message", "error", err)
+	//Tell clients of the versioned protocol what the server supports
+	if c.version > 0 {
+		event, err := c.manager.newHelloEvent("")
+		if err == nil {
+			err = c.transport.WriteEvent(event)
+		}
+		if err != nil {
+			c.logger.Errorw("Error writing hello:", "error", err)
+			return
 		}
 	}
+
+	//Write events and send pings until the connection is closed
+	c.writeEvents(nil, func() error {
+		if err := c.connection.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if !errors.Is(err, websocket.ErrCloseSent) && !errors.Is(err, net.ErrClosed) {
+				c.logger.Errorw("Error writing ping message", "error", err)
+			}
+			return err
+		}
+		return nil
+	})
 }
 
-// WriteMessages is run in a separate goroutine and is used to write messages over websocket connection
-func (c *Client) WriteMessages(ctx context.Context) {
+// writeEvents writes events that were missed or weren't acknowledged before the reconnect and then queued events
+// until the client is removed or stop is closed. Ping keeps the connection alive and is called every pingInterval
+func (c *Client) writeEvents(stop <-chan struct{}, ping func() error) {
 	//Create new ticker
 	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 
-	//Gracefully remove the client
-	defer func() {
-		if err := c.manager.RemoveClient(context.Background(), c); err != nil {
-			c.logger.Errorw("error removing client", "error", err)
+	//Redeliver events that were missed or weren't acknowledged before the reconnect
+	for _, pending := range c.replay {
+		if err := c.transport.WriteEvent(pending.event); err != nil {
+			c.logger.Errorw("Error writing message:", "error", err)
+			return
 		}
-		ticker.Stop()
-	}()
+	}
+	c.replay = nil
 
 	//Infinite loop
 	for {
 		select {
-		case message, ok := <-c.writer:
-			//Check if channel is closed
-			if !ok {
-				//Notify front end that connection channel is closed
-				if err := c.connection.WriteMessage(websocket.CloseMessage, nil); err != nil {
-					c.manager.logger.Errorw("Error writing message:", "error", err)
-				}
-				return
-			}
-
-			//Marshal message into json
-			data, err := json.Marshal(message)
-			if err != nil {
-				c.logger.Errorw("Error marshaling message", "error", err)
-				return
-			}
-
-			//Write text message to the websocket connection
-			if err := c.connection.WriteMessage(websocket.TextMessage, data); err != nil {
+		case event := <-c.writer:
+			if err := c.transport.WriteEvent(event); err != nil {
 				c.logger.Errorw("Error writing message:", "error", err)
 			}
 		case <-ticker.C:
-			//Send the ping
-			if err := c.connection.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				if !errors.Is(err, websocket.ErrCloseSent) && !errors.Is(err, net.ErrClosed) {
-					c.logger.Errorw("Error writing ping message", "error", err)
-				}
+			if err := ping(); err != nil {
 				return
 			}
-
+		case <-c.done:
+			return
+		case <-stop:
+			return
 		}
 	}
-
 }
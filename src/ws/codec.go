@@ -0,0 +1,164 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Websocket subprotocols select protocol version and codec. Clients that don't request a subprotocol
+// use the legacy protocol, see legacyCodec
+const (
+	SubprotocolJSON    = "messenger.v1.json"
+	SubprotocolMsgpack = "messenger.v1.msgpack"
+)
+
+// Codec encodes events sent over websocket connections
+type Codec interface {
+	// MessageType is the websocket message type of encoded events
+	MessageType() int
+	Encode(event Event) ([]byte, error)
+	Decode(data []byte) (Event, error)
+}
+
+// codecs stores codecs by subprotocol
+var codecs = map[string]Codec{
+	SubprotocolJSON:    jsonCodec{},
+	SubprotocolMsgpack: msgpackCodec{},
+}
+
+// Subprotocols returns subprotocols of all codecs, the preferred one first
+func Subprotocols() []string {
+	return []string{SubprotocolMsgpack, SubprotocolJSON}
+}
+
+// codecFor returns codec of the negotiated subprotocol
+func codecFor(subprotocol string) Codec {
+	if codec, ok := codecs[subprotocol]; ok {
+		return codec
+	}
+	return legacyCodec{}
+}
+
+// legacyCodec is used by clients that don't negotiate a subprotocol and only know messages without the envelope.
+// They get only message events as bare json messages, their frames may be either bare messages or events.
+// Legacy clients can't tell an error from a message, so they get no error events. Frames over the size limit
+// close their connection with the reason in the close frame like for other clients
+type legacyCodec struct{}
+
+func (legacyCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+// Encode returns payload of message events and nil for other events, which aren't written
+func (legacyCodec) Encode(event Event) ([]byte, error) {
+	if event.Type != EventMessage {
+		return nil, nil
+	}
+	return event.Payload, nil
+}
+
+func (legacyCodec) Decode(data []byte) (Event, error) {
+	return decodeEvent(data)
+}
+
+// jsonCodec encodes events as json text messages
+type jsonCodec struct{}
+
+func (jsonCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Encode(event Event) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func (jsonCodec) Decode(data []byte) (Event, error) {
+	return decodeEvent(data)
+}
+
+// msgpackCodec encodes events as MessagePack binary messages. Payloads are converted from and to json,
+// so event handlers are the same for every codec
+type msgpackCodec struct{}
+
+// msgpackEvent is an event with payload decoded into maps, slices and scalars
+type msgpackEvent struct {
+	Version int    `msgpack:"v"`
+	Type    string `msgpack:"type"`
+	Id      string `msgpack:"id,omitempty"`
+	Payload any    `msgpack:"payload,omitempty"`
+}
+
+func (msgpackCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) Encode(event Event) ([]byte, error) {
+	payload, err := fromJSON(event.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(msgpackEvent{Version: event.Version, Type: event.Type, Id: event.Id, Payload: payload})
+}
+
+func (msgpackCodec) Decode(data []byte) (Event, error) {
+	var decoded msgpackEvent
+	if err := msgpack.Unmarshal(data, &decoded); err != nil {
+		return Event{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	event := Event{Version: decoded.Version, Type: decoded.Type, Id: decoded.Id}
+	if event.Type == "" {
+		return event, fmt.Errorf("%w: event type is required", ErrBadRequest)
+	}
+	if event.Version > ProtocolVersion {
+		return event, &codeError{code: CodeUnsupportedVersion, message: fmt.Sprintf("protocol version %d isn't supported", event.Version)}
+	}
+
+	//Convert payload to json
+	if decoded.Payload != nil {
+		payload, err := json.Marshal(decoded.Payload)
+		if err != nil {
+			return event, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		event.Payload = payload
+	}
+	return event, nil
+}
+
+// fromJSON decodes json keeping integers as int64 so they aren't encoded as floats
+func fromJSON(data json.RawMessage) (any, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return convertNumbers(value), nil
+}
+
+// convertNumbers replaces json numbers with int64 or float64 values
+func convertNumbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = convertNumbers(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = convertNumbers(item)
+		}
+	}
+	return value
+}
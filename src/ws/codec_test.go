@@ -0,0 +1,90 @@
+package ws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+	event := testEvent(t, EventAck, "1", Ack{Id: "2", ChatId: "3", Seq: 1 << 60, Time: 5})
+	for _, subprotocol := range Subprotocols() {
+		//Check that events survive encoding
+		codec := codecFor(subprotocol)
+		data, err := codec.Encode(event)
+		assert.NoError(t, err)
+		decoded, err := codec.Decode(data)
+		assert.NoError(t, err)
+		assert.Equal(t, event.Type, decoded.Type)
+		assert.Equal(t, event.Id, decoded.Id)
+		var ack Ack
+		assert.NoError(t, decodePayload(decoded, &ack))
+		assert.Equal(t, Ack{Id: "2", ChatId: "3", Seq: 1 << 60, Time: 5}, ack)
+
+		//Check that malformed frames are refused
+		_, err = codec.Decode([]byte{0xc1})
+		assert.Equal(t, CodeBadRequest, errorCode(err))
+	}
+
+	//Check that clients without subprotocol get only bare messages
+	codec := codecFor("")
+	assert.Equal(t, legacyCodec{}, codec)
+	data, err := codec.Encode(event)
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	message := testEvent(t, EventMessage, "", Message{ChatId: "1", Text: "hello"})
+	data, err = codec.Encode(message)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"from":"","chat_id":"1","text":"hello"}`, string(data))
+}
+
+func TestCompressedMsgpack(t *testing.T) {
+	//Create manager and chat
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Serve websocket connections of user1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := m.WSUpgrader.Upgrade(w, r, nil)
+		assert.NoError(t, err)
+		client := NewClient(conn, m, "user1", "")
+		assert.NoError(t, m.AddClient(context.Background(), client))
+		go client.ReadMessages(context.Background())
+		go client.WriteMessages(context.Background())
+	}))
+	defer srv.Close()
+
+	//Connect requesting compression and msgpack
+	dialer := websocket.Dialer{EnableCompression: true, Subprotocols: []string{SubprotocolMsgpack}}
+	conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, SubprotocolMsgpack, conn.Subprotocol())
+	assert.Contains(t, res.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+
+	//Check that the server sends hello first
+	messageType, data, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	event, err := msgpackCodec{}.Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, EventHello, event.Type)
+
+	//Send message and check that the ack is a binary msgpack message
+	data, err = msgpackCodec{}.Encode(testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.WriteMessage(websocket.BinaryMessage, data))
+	messageType, data, err = conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	event, err = msgpackCodec{}.Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, EventAck, event.Type)
+	assert.Equal(t, "1", event.Id)
+}
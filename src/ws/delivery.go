@@ -0,0 +1,321 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dafraer/messenger/src/store"
+)
+
+// maxPending is the maximum number of unacknowledged messages kept for a device.
+// When the queue is full the oldest messages are dropped, the device can still load them from the history
+const maxPending = 1000
+
+// Ack is the payload of ack events. Clients send it after receiving a message
+// and the server sends it to the sender once the message is stored
+type Ack struct {
+	Id     string `json:"id"`
+	ChatId string `json:"chat_id,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
+	Time   int64  `json:"time,omitempty"`
+}
+
+// deviceKey identifies a device of a user
+type deviceKey struct {
+	username string
+	device   string
+}
+
+// pendingEvent is a message event waiting for an ack from the device
+type pendingEvent struct {
+	messageId string
+	chatId    string
+	seq       int64
+	event     Event
+}
+
+// DeviceState is delivery state of a user's device
+type DeviceState struct {
+	Device string `json:"device"`
+	//Online is true while the device has connected clients
+	Online bool `json:"online"`
+	//Pending is the number of messages sent to the device that it hasn't acknowledged
+	Pending int `json:"pending"`
+	//Delivered stores sequence number of the last acknowledged message by chat id
+	Delivered map[string]int64 `json:"delivered"`
+}
+
+// newAckEvent creates an ack replying to the event which carried the message
+func newAckEvent(id string, message Message) (Event, error) {
+	event, err := newEvent(EventAck, Ack{Id: message.Id, ChatId: message.ChatId, Seq: message.Seq, Time: message.Time})
+	event.Id = id
+	return event, err
+}
+
+// deliver sends a new message to the chat members and echoes it to the sender's other devices.
+// The message is queued for every known device of the members except the sender's one and stays queued
+// until the device acknowledges it, so devices that are offline or lose connection before receiving it
+// get it again when they reconnect
+func (m *Manager) deliver(message Message, sender *Client) error {
+	event, err := newEvent(EventMessage, message)
+	if err != nil {
+		return err
+	}
+
+	//Skip the message if it has already come from the stream
+	if !m.claim(store.ChangeInsert, message) {
+		return nil
+	}
+	env := envelope{Route: routeMessage, ChatIds: []string{message.ChatId}, Event: event}
+	if sender != nil {
+		env.Username, env.Device = sender.username, sender.device
+	}
+	return m.dispatch(env, sender)
+}
+
+// deliverLocal queues message for devices of the chat members except the sender's device
+// and sends it to clients connected to this manager except the sender
+func (m *Manager) deliverLocal(message Message, event Event, senderKey deviceKey, sender *Client) {
+	//Group members and users with subscribed clients by their delivery shards
+	h := m.hubs.lookup(message.ChatId)
+	if h == nil {
+		return
+	}
+	shards := make(map[*deliveryShard]map[string]bool)
+	addUser := func(username string) {
+		d := m.deliveries.shard(username)
+		if shards[d] == nil {
+			shards[d] = make(map[string]bool)
+		}
+		shards[d][username] = true
+	}
+	h.mu.RLock()
+	for username := range h.members {
+		addUser(username)
+	}
+	for client := range h.clients {
+		addUser(client.username)
+	}
+	h.mu.RUnlock()
+
+	//Queue message and snapshot recipients under the lock of their delivery state so
+	//clients connecting meanwhile get the message exactly once. Only shards of the recipients are locked
+	var recipients []*Client
+	pending := pendingEvent{messageId: message.Id, chatId: message.ChatId, seq: message.Seq, event: event}
+	for d, usernames := range shards {
+		d.mu.Lock()
+		h.mu.RLock()
+		for username := range usernames {
+			if !h.members[username] {
+				continue
+			}
+			for id := range d.devices[username] {
+				key := deviceKey{username: username, device: id}
+				if key != senderKey {
+					d.enqueue(key, pending)
+				}
+			}
+		}
+		for client := range h.clients {
+			if usernames[client.username] && client != sender {
+				recipients = append(recipients, client)
+			}
+		}
+		h.mu.RUnlock()
+		d.mu.Unlock()
+	}
+
+	for _, client := range recipients {
+		client.send(event)
+	}
+}
+
+// deliveryShard stores delivery state of the users whose usernames hash into the shard
+type deliveryShard struct {
+	mu sync.Mutex
+	//devices stores known devices of each user by device id, see registerDevice
+	devices map[string]map[string]*device
+	//pending stores messages that weren't acknowledged by a device, see deliver
+	pending map[deviceKey][]pendingEvent
+	//delivered stores sequence numbers of the last messages acknowledged by a device by chat id
+	delivered map[deviceKey]map[string]int64
+	//swept is the time devices were last checked for expiry
+	swept time.Time
+}
+
+// device tracks connections of a user's device
+type device struct {
+	//clients is the number of connected clients of the device
+	clients int
+	//seen is the time the device last connected or disconnected
+	seen time.Time
+}
+
+// deliveries stores delivery state split into shards by username, so deliveries
+// to users of different shards never wait for each other
+type deliveries struct {
+	shards [shardCount]deliveryShard
+}
+
+// shard returns the delivery state shard of the user
+func (d *deliveries) shard(username string) *deliveryShard {
+	s := &d.shards[shardIndex(username)]
+	s.mu.Lock()
+	if s.devices == nil {
+		s.devices = make(map[string]map[string]*device)
+		s.pending = make(map[deviceKey][]pendingEvent)
+		s.delivered = make(map[deviceKey]map[string]int64)
+	}
+	s.mu.Unlock()
+	return s
+}
+
+// enqueue adds event to the device's pending queue dropping the oldest one if the queue is full.
+// Must be called with mu held
+func (d *deliveryShard) enqueue(key deviceKey, pending pendingEvent) {
+	queue := d.pending[key]
+	if len(queue) >= maxPending {
+		queue = queue[1:]
+	}
+	d.pending[key] = append(queue, pending)
+}
+
+// ack removes acknowledged message from the device's pending queue and updates the device's delivery state
+func (m *Manager) ack(key deviceKey, messageId string) {
+	d := m.deliveries.shard(key.username)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pending[key] = slices.DeleteFunc(d.pending[key], func(pending pendingEvent) bool {
+		if pending.messageId != messageId {
+			return false
+		}
+		if d.delivered[key] == nil {
+			d.delivered[key] = make(map[string]int64)
+		}
+		d.delivered[key][pending.chatId] = max(d.delivered[key][pending.chatId], pending.seq)
+		return true
+	})
+	if len(d.pending[key]) == 0 {
+		delete(d.pending, key)
+	}
+}
+
+// registerDevice remembers the device of a connected client and returns events it hasn't acknowledged yet.
+// Users keep at most maxDevices devices, the least recently seen one is forgotten to make room for a new one.
+// Devices that haven't been connected for ttl are forgotten too. Must be called with mu held
+func (d *deliveryShard) registerDevice(client *Client, maxDevices int, ttl time.Duration, now time.Time) []pendingEvent {
+	d.expire(ttl, now)
+
+	devices := d.devices[client.username]
+	if devices == nil {
+		devices = make(map[string]*device)
+		d.devices[client.username] = devices
+	}
+	dev, ok := devices[client.device]
+	if !ok {
+		if maxDevices > 0 && len(devices) >= maxDevices {
+			d.evict(client.username)
+		}
+		dev = &device{}
+		devices[client.device] = dev
+	}
+	dev.clients++
+	dev.seen = now
+
+	return slices.Clone(d.pending[client.deviceKey()])
+}
+
+// unregisterDevice notes that a client of the device has disconnected. Must be called with mu held
+func (d *deliveryShard) unregisterDevice(key deviceKey, now time.Time) {
+	if dev, ok := d.devices[key.username][key.device]; ok {
+		dev.clients--
+		dev.seen = now
+	}
+}
+
+// evict forgets the least recently seen device of the user, devices without connected clients go first.
+// Must be called with mu held
+func (d *deliveryShard) evict(username string) {
+	var oldest string
+	var oldestDevice *device
+	for id, dev := range d.devices[username] {
+		if oldestDevice == nil ||
+			(dev.clients == 0) != (oldestDevice.clients == 0) && dev.clients == 0 ||
+			(dev.clients == 0) == (oldestDevice.clients == 0) && dev.seen.Before(oldestDevice.seen) {
+			oldest, oldestDevice = id, dev
+		}
+	}
+	if oldestDevice != nil {
+		d.forget(deviceKey{username: username, device: oldest})
+	}
+}
+
+// expire forgets devices that have no connected clients and weren't seen for ttl.
+// Devices are checked at most once per sweepInterval. Must be called with mu held
+func (d *deliveryShard) expire(ttl time.Duration, now time.Time) {
+	if ttl <= 0 || now.Sub(d.swept) < sweepInterval {
+		return
+	}
+	d.swept = now
+	for username, devices := range d.devices {
+		for id, dev := range devices {
+			if dev.clients == 0 && now.Sub(dev.seen) > ttl {
+				d.forget(deviceKey{username: username, device: id})
+			}
+		}
+	}
+}
+
+// forget removes the device with its pending messages and delivery state. Must be called with mu held
+func (d *deliveryShard) forget(key deviceKey) {
+	delete(d.devices[key.username], key.device)
+	if len(d.devices[key.username]) == 0 {
+		delete(d.devices, key.username)
+	}
+	delete(d.pending, key)
+	delete(d.delivered, key)
+}
+
+// Devices returns delivery state of the user's known devices sorted by device id
+func (m *Manager) Devices(username string) []DeviceState {
+	d := m.deliveries.shard(username)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	devices := make([]DeviceState, 0, len(d.devices[username]))
+	for id, dev := range d.devices[username] {
+		key := deviceKey{username: username, device: id}
+		devices = append(devices, DeviceState{
+			Device:    id,
+			Online:    dev.clients > 0,
+			Pending:   len(d.pending[key]),
+			Delivered: maps.Clone(d.delivered[key]),
+		})
+		if devices[len(devices)-1].Delivered == nil {
+			devices[len(devices)-1].Delivered = make(map[string]int64)
+		}
+	}
+	slices.SortFunc(devices, func(a, b DeviceState) int {
+		return strings.Compare(a.Device, b.Device)
+	})
+	return devices
+}
+
+// handleAck removes message acknowledged by the client from its device's pending queue
+func (m *Manager) handleAck(ctx context.Context, c *Client, event Event) error {
+	var request Ack
+	if err := decodePayload(event, &request); err != nil {
+		return err
+	}
+	if request.Id == "" {
+		return fmt.Errorf("%w: message id is required", ErrBadRequest)
+	}
+	m.ack(c.deviceKey(), request.Id)
+	return nil
+}
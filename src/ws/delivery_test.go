@@ -0,0 +1,155 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelivery(t *testing.T) {
+	//Create manager with in-memory storage
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Connect sender and two devices of the receiver
+	sender := newTestDevice(t, m, "user1", "laptop")
+	phone, tablet := newTestDevice(t, m, "user2", "phone"), newTestDevice(t, m, "user2", "tablet")
+
+	//Send two messages and check that sender gets acks with assigned ids
+	var acks []Ack
+	for i, text := range []string{"first", "second"} {
+		m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, text, Message{ChatId: chatIdHex(chatId), Text: text}))
+		event := <-sender.writer
+		assert.Equal(t, EventAck, event.Type)
+		assert.Equal(t, text, event.Id)
+		var ack Ack
+		assert.NoError(t, json.Unmarshal(event.Payload, &ack))
+		assert.Equal(t, int64(i+1), ack.Seq)
+		acks = append(acks, ack)
+	}
+	assert.Len(t, phone.writer, 2)
+	assert.Len(t, tablet.writer, 2)
+
+	//Phone acknowledges the first message, tablet doesn't acknowledge anything
+	m.handleEvent(context.Background(), phone, testEvent(t, EventAck, "", Ack{Id: acks[0].Id}))
+
+	//Check that devices get unacknowledged messages after reconnecting
+	assert.Equal(t, []string{acks[1].Id}, replayedIds(newTestDevice(t, m, "user2", "phone")))
+	assert.Equal(t, []string{acks[0].Id, acks[1].Id}, replayedIds(newTestDevice(t, m, "user2", "tablet")))
+
+	//Check that sender's device doesn't get its own messages
+	assert.Empty(t, newTestDevice(t, m, "user1", "laptop").replay)
+
+	//Check that acks without message id are refused
+	<-phone.writer
+	<-phone.writer
+	m.handleEvent(context.Background(), phone, testEvent(t, EventAck, "3", Ack{}))
+	assertErrorEvent(t, <-phone.writer, "3", CodeBadRequest)
+}
+
+func TestDevices(t *testing.T) {
+	//Create manager with in-memory storage
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Connect two devices of the sender and one of the receiver
+	laptop, phone := newTestDevice(t, m, "user1", "laptop"), newTestDevice(t, m, "user1", "phone")
+	receiver := newTestDevice(t, m, "user2", "tablet")
+
+	//Send message and check that it's echoed to the sender's other device
+	m.handleEvent(context.Background(), laptop, testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	assert.Equal(t, EventAck, (<-laptop.writer).Type)
+	for _, c := range []*Client{phone, receiver} {
+		event := <-c.writer
+		assert.Equal(t, EventMessage, event.Type)
+		var msg Message
+		assert.NoError(t, json.Unmarshal(event.Payload, &msg))
+		assert.Equal(t, "user1", msg.From)
+	}
+	assert.Empty(t, laptop.writer)
+
+	//Check that unknown acks don't change delivery state
+	m.handleEvent(context.Background(), phone, testEvent(t, EventAck, "", Ack{Id: "missing"}))
+	assert.Equal(t, []DeviceState{
+		{Device: "laptop", Online: true, Delivered: map[string]int64{}},
+		{Device: "phone", Online: true, Pending: 1, Delivered: map[string]int64{}},
+	}, m.Devices("user1"))
+	//Reconnect the phone, acknowledge replayed message and close the old connection
+	ids := replayedIds(newTestDevice(t, m, "user1", "phone"))
+	m.handleEvent(context.Background(), phone, testEvent(t, EventAck, "", Ack{Id: ids[0]}))
+	assert.NoError(t, m.RemoveClient(context.Background(), phone))
+
+	//Check delivery state of the sender's devices
+	assert.Equal(t, []DeviceState{
+		{Device: "laptop", Online: true, Delivered: map[string]int64{}},
+		{Device: "phone", Online: true, Delivered: map[string]int64{chatIdHex(chatId): 1}},
+	}, m.Devices("user1"))
+}
+
+func TestDeviceLimits(t *testing.T) {
+	var deliveries deliveries
+	d := deliveries.shard("user1")
+	start := time.Now()
+	connect := func(device string, now time.Time) deviceKey {
+		client := &Client{username: "user1", device: device}
+		d.registerDevice(client, 2, time.Hour, now)
+		return client.deviceKey()
+	}
+
+	//Connect two devices and disconnect the first one with a pending message
+	laptop := connect("laptop", start)
+	connect("phone", start.Add(time.Second))
+	d.enqueue(laptop, pendingEvent{messageId: "1"})
+	d.unregisterDevice(laptop, start.Add(2*time.Second))
+
+	//Check that the offline device is evicted with its messages when the limit is reached
+	connect("tablet", start.Add(3*time.Second))
+	assert.Len(t, d.devices["user1"], 2)
+	assert.NotContains(t, d.devices["user1"], "laptop")
+	assert.Empty(t, d.pending[laptop])
+
+	//Check that the least recently seen device is evicted if all devices are online
+	connect("desktop", start.Add(4*time.Second))
+	assert.NotContains(t, d.devices["user1"], "phone")
+	assert.Contains(t, d.devices["user1"], "tablet")
+
+	//Check that devices are forgotten once they stay disconnected for the ttl
+	d.unregisterDevice(deviceKey{username: "user1", device: "tablet"}, start.Add(5*time.Second))
+	connect("desktop", start.Add(2*time.Hour))
+	assert.Len(t, d.devices["user1"], 1)
+	assert.Contains(t, d.devices["user1"], "desktop")
+}
+
+// newTestDevice registers a client of the user's device without websocket connection.
+// Presence events sent to other clients when it connects are dropped
+func newTestDevice(t *testing.T, m *Manager, username, device string) *Client {
+	c := &Client{username: username, device: device, manager: m, writer: make(chan Event, 16), logger: m.logger}
+	assert.NoError(t, m.AddClient(context.Background(), c))
+	for client := range m.clients {
+		//Put back other events keeping their order
+		var events []Event
+		for len(client.writer) > 0 {
+			if event := <-client.writer; event.Type != EventPresence {
+				events = append(events, event)
+			}
+		}
+		for _, event := range events {
+			client.writer <- event
+		}
+	}
+	return c
+}
+
+// replayedIds returns ids of messages redelivered to the client
+func replayedIds(c *Client) []string {
+	var ids []string
+	for _, pending := range c.replay {
+		ids = append(ids, pending.messageId)
+	}
+	return ids
+}
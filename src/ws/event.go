@@ -0,0 +1,298 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dafraer/messenger/src/store"
+)
+
+// ProtocolVersion is the version of the event envelope
+const ProtocolVersion = 1
+
+// Event types
+const (
+	//EventMessage is a new chat message
+	EventMessage = "message"
+	//EventEdit replaces text of a message sent earlier
+	EventEdit = "edit"
+	//EventDelete deletes a message for everyone
+	EventDelete = "delete"
+	//EventHide deletes a message only for the user who sends it
+	EventHide = "hide"
+	//EventAck acknowledges a message. Clients send it after receiving a message
+	//and the server sends it to the sender after the message is stored
+	EventAck = "ack"
+	//EventRead marks messages as read. Clients send it and the server sends it to the other chat members as a receipt
+	EventRead = "read"
+	//EventTypingStart and EventTypingStop show that a user is typing in a chat. They are relayed but never stored
+	EventTypingStart = "typing_start"
+	EventTypingStop  = "typing_stop"
+	//EventPresence is sent when a user who shares a chat comes online or goes offline
+	EventPresence = "presence"
+	//EventResumed is sent after messages missed while the client was offline were replayed
+	EventResumed = "resumed"
+	//EventHello describes capabilities of the server or the client, see Hello
+	EventHello = "hello"
+	//EventChunk carries a part of an event too large for a single frame, see Chunk
+	EventChunk = "chunk"
+	//EventRequest calls a method on the server, see Request. EventResponse carries the result and the id of the request
+	EventRequest  = "request"
+	EventResponse = "response"
+	//EventConnected is sent to server-sent events and long-poll clients, it carries the id they send their events with
+	EventConnected = "connected"
+	//EventError is sent to the client when its event can't be handled
+	EventError = "error"
+)
+
+// Error codes sent in error events
+const (
+	CodeBadRequest         = "bad_request"
+	CodeUnknownType        = "unknown_type"
+	CodeUnknownMethod      = "unknown_method"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeTooLarge           = "too_large"
+	CodeSlowDown           = "slow_down"
+	CodeInternal           = "internal"
+)
+
+// ErrBadRequest is returned by event handlers when event payload is invalid
+var ErrBadRequest = errors.New("bad request")
+
+// Event is an envelope that wraps every frame sent over websocket in both directions
+type Event struct {
+	//Version of the envelope, see ProtocolVersion
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	//Id is chosen by the client and is echoed in events that reply to it
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ErrorPayload is the payload of an error event
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	//Limit is the size limit in bytes of too_large errors
+	Limit int `json:"limit,omitempty"`
+	//RetryAfter is the number of milliseconds to wait before sending again after slow_down errors
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+// EventHandler handles an event received from a client. Returned error is sent back to the client as an error event
+type EventHandler func(ctx context.Context, c *Client, event Event) error
+
+// newEvent wraps payload into an event
+func newEvent(eventType string, payload any) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Version: ProtocolVersion, Type: eventType, Payload: data}, nil
+}
+
+// newErrorEvent creates an error event replying to the event with the given id
+func newErrorEvent(id string, err error) Event {
+	payload := ErrorPayload{Code: errorCode(err), Message: err.Error()}
+	var tooLarge *TooLargeError
+	if errors.As(err, &tooLarge) {
+		payload.Limit = tooLarge.Limit
+	}
+	var slowDown *SlowDownError
+	if errors.As(err, &slowDown) {
+		payload.RetryAfter = slowDown.RetryAfter.Milliseconds()
+	}
+
+	//Don't leak internal errors to the client
+	if payload.Code == CodeInternal {
+		payload.Message = "internal error"
+	}
+
+	event, _ := newEvent(EventError, payload)
+	event.Id = id
+	return event
+}
+
+// errorCode maps handler errors to error codes
+func errorCode(err error) string {
+	var codeErr *codeError
+	var tooLarge *TooLargeError
+	var slowDown *SlowDownError
+	switch {
+	case errors.As(err, &codeErr):
+		return codeErr.code
+	case errors.As(err, &tooLarge):
+		return CodeTooLarge
+	case errors.As(err, &slowDown):
+		return CodeSlowDown
+	case errors.Is(err, ErrBadRequest):
+		return CodeBadRequest
+	case errors.Is(err, ErrForbidden):
+		return CodeForbidden
+	case errors.Is(err, store.ErrNotFound):
+		return CodeNotFound
+	case errors.Is(err, store.ErrInvalidCursor):
+		return CodeBadRequest
+	}
+	return CodeInternal
+}
+
+// codeError is an error with an explicit error code
+type codeError struct {
+	code    string
+	message string
+}
+
+func (e *codeError) Error() string {
+	return e.message
+}
+
+// decodeEvent parses a frame received from the client. Frames without type are treated as messages
+// in the format used before the envelope was introduced
+func decodeEvent(data []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return Event{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+
+	//Wrap legacy messages into an envelope
+	if event.Type == "" {
+		return Event{Type: EventMessage, Payload: data}, nil
+	}
+
+	if event.Version > ProtocolVersion {
+		return event, &codeError{code: CodeUnsupportedVersion, message: fmt.Sprintf("protocol version %d isn't supported", event.Version)}
+	}
+	return event, nil
+}
+
+// decodePayload parses event payload
+func decodePayload(event Event, payload any) error {
+	if err := json.Unmarshal(event.Payload, payload); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return nil
+}
+
+// Handle registers handler for the event type replacing the existing one
+func (m *Manager) Handle(eventType string, handler EventHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[eventType] = handler
+}
+
+// handleEvent routes event to its handler and replies with an error event if it fails
+func (m *Manager) handleEvent(ctx context.Context, c *Client, event Event) {
+	m.mu.RLock()
+	handler, ok := m.handlers[event.Type]
+	m.mu.RUnlock()
+
+	//Refuse unknown events
+	if !ok {
+		c.send(newErrorEvent(event.Id, &codeError{code: CodeUnknownType, message: fmt.Sprintf("unknown event type %q", event.Type)}))
+		return
+	}
+
+	if err := handler(ctx, c, event); err != nil {
+		if errorCode(err) == CodeInternal {
+			m.logger.Errorw("Error handling event", "type", event.Type, "error", err)
+		}
+		c.send(newErrorEvent(event.Id, err))
+	}
+}
+
+// registerDefaultHandlers registers handlers of the built-in events
+func (m *Manager) registerDefaultHandlers() {
+	m.handlers[EventMessage] = m.handleMessage
+	m.handlers[EventEdit] = m.handleEdit
+	m.handlers[EventDelete] = m.handleDelete
+	m.handlers[EventHide] = m.handleHide
+	m.handlers[EventAck] = m.handleAck
+	m.handlers[EventRead] = m.handleRead
+	m.handlers[EventTypingStart] = m.handleTypingStart
+	m.handlers[EventTypingStop] = m.handleTypingStop
+	m.handlers[EventHello] = m.handleHello
+	m.handlers[EventChunk] = m.handleChunk
+	m.handlers[EventRequest] = m.handleRequest
+}
+
+// handleMessage saves a new message and sends it to the chat members
+func (m *Manager) handleMessage(ctx context.Context, c *Client, event Event) error {
+	var request Message
+	if err := decodePayload(event, &request); err != nil {
+		return err
+	}
+
+	//Refuse messages to chats where user isn't a member
+	member, err := m.isMember(ctx, request.ChatId, c.username)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return ErrForbidden
+	}
+
+	//Refuse messages sent faster than rate limits allow
+	if err := m.limit(c, request.ChatId); err != nil {
+		return err
+	}
+
+	//Hold the stream back until the message is claimed, so it's sent with the sender's device known
+	defer m.startSending(request.ChatId, c.username)()
+
+	//Save message to the database so it gets an id and a sequence number before it is sent to anyone.
+	//Message author is set to the actual client to prevent impersonation
+	saved, err := m.store.SaveMessage(ctx, store.Message{ChatId: request.ChatId, From: c.username, Text: request.Text, Time: now()})
+	if err != nil {
+		return err
+	}
+
+	//Sending a message ends typing
+	if err := m.stopTyping(typingKey{chatId: request.ChatId, username: c.username}, c); err != nil {
+		return err
+	}
+
+	//Let the sender know the message is stored so it doesn't need to be sent again
+	message := newMessage(saved)
+	ack, err := newAckEvent(event.Id, message)
+	if err != nil {
+		return err
+	}
+	c.send(ack)
+
+	//Send message to other chat members
+	return m.deliver(message, c)
+}
+
+// handleEdit edits a message sent earlier
+func (m *Manager) handleEdit(ctx context.Context, c *Client, event Event) error {
+	var request Message
+	if err := decodePayload(event, &request); err != nil {
+		return err
+	}
+	_, err := m.EditMessage(ctx, c.username, request.ChatId, request.Id, request.Text)
+	return err
+}
+
+// handleDelete deletes a message for everyone
+func (m *Manager) handleDelete(ctx context.Context, c *Client, event Event) error {
+	var request Message
+	if err := decodePayload(event, &request); err != nil {
+		return err
+	}
+	_, err := m.DeleteMessage(ctx, c.username, request.ChatId, request.Id)
+	return err
+}
+
+// handleHide deletes a message only for the user
+func (m *Manager) handleHide(ctx context.Context, c *Client, event Event) error {
+	var request Message
+	if err := decodePayload(event, &request); err != nil {
+		return err
+	}
+	return m.HideMessage(ctx, c.username, request.ChatId, request.Id)
+}
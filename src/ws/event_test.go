@@ -0,0 +1,187 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dafraer/messenger/src/store"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+func TestDecodeEvent(t *testing.T) {
+	//Decode event in the envelope
+	event, err := decodeEvent([]byte(`{"v":1,"type":"edit","id":"42","payload":{"chat_id":"1","id":"2","text":"hello"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, EventEdit, event.Type)
+	assert.Equal(t, "42", event.Id)
+
+	//Check that legacy messages without envelope are decoded as message events
+	event, err = decodeEvent([]byte(`{"chat_id":"1","text":"hello"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, EventMessage, event.Type)
+	var msg Message
+	assert.NoError(t, decodePayload(event, &msg))
+	assert.Equal(t, "hello", msg.Text)
+
+	//Check that newer protocol versions and malformed frames are refused
+	_, err = decodeEvent([]byte(`{"v":99,"type":"message"}`))
+	assert.Equal(t, CodeUnsupportedVersion, errorCode(err))
+	_, err = decodeEvent([]byte(`not json`))
+	assert.Equal(t, CodeBadRequest, errorCode(err))
+}
+
+func TestHandleEvent(t *testing.T) {
+	//Create manager with in-memory storage
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Connect both chat members
+	sender, receiver := newTestClient(t, m, "user1"), newTestClient(t, m, "user2")
+
+	//Send message and check that the other member receives it
+	m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	event := <-receiver.writer
+	assert.Equal(t, EventMessage, event.Type)
+	var msg Message
+	assert.NoError(t, json.Unmarshal(event.Payload, &msg))
+	assert.Equal(t, "user1", msg.From)
+	assert.Equal(t, "hello", msg.Text)
+	assert.Equal(t, int64(1), msg.Seq)
+
+	//Check that sender gets an ack once message is stored
+	event = <-sender.writer
+	assert.Equal(t, EventAck, event.Type)
+	assert.Equal(t, "1", event.Id)
+
+	//Check that unknown events get an error reply with the same id
+	m.handleEvent(context.Background(), sender, Event{Version: ProtocolVersion, Type: "dance", Id: "2"})
+	assertErrorEvent(t, <-sender.writer, "2", CodeUnknownType)
+
+	//Check that only the author can edit the message
+	m.handleEvent(context.Background(), receiver, testEvent(t, EventEdit, "3", Message{ChatId: chatIdHex(chatId), Id: msg.Id, Text: "hijacked"}))
+	assertErrorEvent(t, <-receiver.writer, "3", CodeForbidden)
+
+	//Check that custom handlers can be registered
+	m.Handle("ping", func(ctx context.Context, c *Client, event Event) error {
+		pong, err := newEvent("pong", struct{}{})
+		pong.Id = event.Id
+		c.send(pong)
+		return err
+	})
+	m.handleEvent(context.Background(), sender, Event{Version: ProtocolVersion, Type: "ping", Id: "4"})
+	event = <-sender.writer
+	assert.Equal(t, "pong", event.Type)
+	assert.Equal(t, "4", event.Id)
+}
+
+// newTestManager creates websocket manager backed by in-memory storage
+func newTestManager(t *testing.T) (*Manager, *store.MemoryStore) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	storage := store.NewMemoryStore()
+	return NewManager(logger.Sugar(), storage), storage
+}
+
+// newTestClient registers a client without websocket connection. Events sent to it are buffered in its writer
+func newTestClient(t *testing.T, m *Manager, username string) *Client {
+	return newTestDevice(t, m, username, "")
+}
+
+// testEvent wraps payload into an event with the given id
+func testEvent(t *testing.T, eventType, id string, payload any) Event {
+	event, err := newEvent(eventType, payload)
+	assert.NoError(t, err)
+	event.Id = id
+	return event
+}
+
+// assertErrorEvent checks that event is an error reply with the given id and code
+func assertErrorEvent(t *testing.T, event Event, id, code string) {
+	assert.Equal(t, EventError, event.Type)
+	assert.Equal(t, id, event.Id)
+	var payload ErrorPayload
+	assert.NoError(t, json.Unmarshal(event.Payload, &payload))
+	assert.Equal(t, code, payload.Code)
+}
+
+// chatIdHex converts chat id returned by NewChat into a string
+func chatIdHex(id interface{}) string {
+	return id.(primitive.ObjectID).Hex()
+}
+
+func TestMembership(t *testing.T) {
+	//Create manager with in-memory storage
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Connect a member and an outsider
+	member, outsider := newTestClient(t, m, "user2"), newTestClient(t, m, "user3")
+
+	//Check that outsider can't write into the chat and nothing is saved
+	m.handleEvent(context.Background(), outsider, testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "spam"}))
+	assertErrorEvent(t, <-outsider.writer, "1", CodeForbidden)
+	messages, err := storage.GetMessages(context.Background(), chatIdHex(chatId))
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	//Check that messages to missing chats are refused
+	m.handleEvent(context.Background(), outsider, testEvent(t, EventMessage, "2", Message{ChatId: primitive.NewObjectID().Hex(), Text: "spam"}))
+	assertErrorEvent(t, <-outsider.writer, "2", CodeNotFound)
+
+	//Remove the member and check that cached membership is refreshed
+	assert.NoError(t, storage.RemoveUserFromChat(context.Background(), "user2", chatIdHex(chatId)))
+	m.RemoveChatMember(chatIdHex(chatId), "user2")
+	m.handleEvent(context.Background(), member, testEvent(t, EventMessage, "3", Message{ChatId: chatIdHex(chatId), Text: "bye"}))
+	assertErrorEvent(t, <-member.writer, "3", CodeForbidden)
+}
+
+// slowStore blocks the first GetChat call after reading the chat until release is closed
+type slowStore struct {
+	*store.MemoryStore
+	blocked atomic.Bool
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) GetChat(ctx context.Context, chatId string) (*store.Chat, error) {
+	chat, err := s.MemoryStore.GetChat(ctx, chatId)
+	if s.blocked.CompareAndSwap(false, true) {
+		s.loading <- struct{}{}
+		<-s.release
+	}
+	return chat, err
+}
+
+func TestMembershipRemovedWhileLoading(t *testing.T) {
+	//Create manager with storage that stalls loading members
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	storage := &slowStore{MemoryStore: store.NewMemoryStore(), loading: make(chan struct{}), release: make(chan struct{})}
+	m := NewManager(logger.Sugar(), storage)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Start loading members and remove a member meanwhile
+	result := make(chan bool)
+	go func() {
+		member, err := m.isMember(context.Background(), chatIdHex(chatId), "user2")
+		assert.NoError(t, err)
+		result <- member
+	}()
+	<-storage.loading
+	assert.NoError(t, storage.RemoveUserFromChat(context.Background(), "user2", chatIdHex(chatId)))
+	m.RemoveChatMember(chatIdHex(chatId), "user2")
+	close(storage.release)
+
+	//Check that stale members aren't cached
+	assert.False(t, <-result)
+	member, err := m.isMember(context.Background(), chatIdHex(chatId), "user2")
+	assert.NoError(t, err)
+	assert.False(t, member)
+}
@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"context"
+	"slices"
+)
+
+// ServerVersion is the version of the server sent in hello events, it's set at build time
+var ServerVersion = "dev"
+
+// Hello is the payload of hello events. The server sends it to clients of the versioned protocol on connect,
+// clients may send it to get it again and to list events they handle
+type Hello struct {
+	//Version is the protocol version of the connection
+	Version int `json:"version"`
+	//Server is the server version
+	Server string `json:"server,omitempty"`
+	//Events lists event types the sender handles. When client lists them it gets only events of these types,
+	//errors and hello events are always sent
+	Events []string `json:"events,omitempty"`
+	//Methods lists methods of request events the server handles
+	Methods []string `json:"methods,omitempty"`
+	//MaxFrameSize is the maximum size of a frame the server reads, larger events must be sent in chunks
+	MaxFrameSize int `json:"max_frame_size,omitempty"`
+	//MaxMessageSize is the maximum size of an event reassembled from chunks
+	MaxMessageSize int `json:"max_message_size,omitempty"`
+	//SendBuffer is the number of events queued for the client before the overflow policy applies
+	SendBuffer int `json:"send_buffer,omitempty"`
+}
+
+// newHelloEvent creates hello event describing server capabilities
+func (m *Manager) newHelloEvent(id string) (Event, error) {
+	m.mu.RLock()
+	events := make([]string, 0, len(m.handlers))
+	for eventType := range m.handlers {
+		events = append(events, eventType)
+	}
+	methods := make([]string, 0, len(m.methods))
+	for name := range m.methods {
+		methods = append(methods, name)
+	}
+	m.mu.RUnlock()
+	slices.Sort(events)
+	slices.Sort(methods)
+
+	event, err := newEvent(EventHello, Hello{
+		Version:        ProtocolVersion,
+		Server:         ServerVersion,
+		Events:         events,
+		Methods:        methods,
+		MaxFrameSize:   m.MaxFrameSize,
+		MaxMessageSize: m.MaxMessageSize,
+		SendBuffer:     m.SendBuffer,
+	})
+	event.Id = id
+	return event, err
+}
+
+// handleHello remembers events the client handles and replies with server capabilities
+func (m *Manager) handleHello(ctx context.Context, c *Client, event Event) error {
+	var request Hello
+	if err := decodePayload(event, &request); err != nil {
+		return err
+	}
+
+	//Limit events sent to the client
+	if request.Events != nil {
+		accepts := make(map[string]bool, len(request.Events))
+		for _, eventType := range request.Events {
+			accepts[eventType] = true
+		}
+		c.accepts.Store(&accepts)
+	}
+
+	reply, err := m.newHelloEvent(event.Id)
+	if err != nil {
+		return err
+	}
+	c.send(reply)
+	return nil
+}
+
+// accepted reports whether the client handles events of the type
+func (c *Client) accepted(eventType string) bool {
+	switch eventType {
+	case EventError, EventHello, EventConnected:
+		return true
+	}
+	accepts := c.accepts.Load()
+	return accepts == nil || (*accepts)[eventType]
+}
@@ -0,0 +1,40 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHello(t *testing.T) {
+	//Create manager with a chat
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	sender, receiver := newTestClient(t, m, "user1"), newTestClient(t, m, "user2")
+
+	//Check that hello reply describes server capabilities
+	m.handleEvent(context.Background(), receiver, testEvent(t, EventHello, "1", Hello{Version: ProtocolVersion, Events: []string{EventMessage}}))
+	event := <-receiver.writer
+	assert.Equal(t, EventHello, event.Type)
+	assert.Equal(t, "1", event.Id)
+	var hello Hello
+	assert.NoError(t, json.Unmarshal(event.Payload, &hello))
+	assert.Equal(t, ProtocolVersion, hello.Version)
+	assert.Equal(t, ServerVersion, hello.Server)
+	assert.Equal(t, DefaultMaxFrameSize, hello.MaxFrameSize)
+	assert.Equal(t, DefaultMaxMessageSize, hello.MaxMessageSize)
+	assert.Contains(t, hello.Events, EventTypingStart)
+
+	//Check that client gets only events it listed
+	m.handleEvent(context.Background(), sender, testEvent(t, EventTypingStart, "", Typing{ChatId: chatIdHex(chatId)}))
+	m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, "", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	assert.Equal(t, EventMessage, (<-receiver.writer).Type)
+	assert.Empty(t, receiver.writer)
+
+	//Check that errors are sent even if client didn't list them
+	m.handleEvent(context.Background(), receiver, testEvent(t, "unknown", "2", nil))
+	assertErrorEvent(t, <-receiver.writer, "2", CodeUnknownType)
+}
@@ -0,0 +1,276 @@
+package ws
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// shardCount is the number of registry shards. Chats are spread between shards by the hash of chat id
+const shardCount = 32
+
+// hub routes events of a single chat. Every hub has its own lock so membership changes
+// and broadcasts in one chat never block other chats. Store I/O is never done while the lock is held
+type hub struct {
+	mu sync.RWMutex
+	//clients stores connected clients subscribed to the chat
+	clients ClientList
+	//members caches usernames of chat members, it is nil until members are loaded, see isMember
+	members map[string]bool
+	//generation is incremented whenever members change, so members loaded meanwhile aren't cached
+	generation uint64
+	//typing stores expiry timers of users typing in the chat by username
+	typing map[string]*typingTimer
+	//dropped is set when the hub is removed from the registry, clients are subscribed to the new hub of the chat then
+	dropped bool
+}
+
+// newHub creates an empty hub
+func newHub() *hub {
+	return &hub{clients: make(ClientList), typing: make(map[string]*typingTimer)}
+}
+
+// snapshot returns clients subscribed to the chat so events can be sent without holding the lock
+func (h *hub) snapshot() []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// setMembers replaces cached members of the chat. Must be called with mu held
+func (h *hub) setMembers(members []string) {
+	h.generation++
+	h.members = make(map[string]bool, len(members))
+	for _, member := range members {
+		h.members[member] = true
+	}
+}
+
+// idle reports whether the hub holds no state and can be dropped. Must be called with mu held
+func (h *hub) idle() bool {
+	return len(h.clients) == 0 && h.members == nil && len(h.typing) == 0
+}
+
+// shard holds hubs of a part of the chats
+type shard struct {
+	mu   sync.Mutex
+	hubs map[string]*hub
+	//generation is incremented when a hub is dropped or members of a chat without a hub change, see membersVersion
+	generation uint64
+}
+
+// registry stores chat hubs split into shards, so looking up a hub locks only its shard.
+// Hubs are created when clients subscribe or members of an existing chat are loaded and dropped when they become idle
+type registry struct {
+	shards [shardCount]shard
+}
+
+// membersVersion identifies membership state of a chat. Members loaded from the storage are cached
+// only if the version hasn't changed while they were loading
+type membersVersion struct {
+	hub             *hub
+	hubGeneration   uint64
+	shardGeneration uint64
+}
+
+// hub returns the chat's hub creating it if needed
+func (r *registry) hub(chatId string) *hub {
+	s := r.shard(chatId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hub(chatId)
+}
+
+// hub returns the chat's hub creating it if needed. Must be called with mu held
+func (s *shard) hub(chatId string) *hub {
+	if s.hubs == nil {
+		s.hubs = make(map[string]*hub)
+	}
+	h, ok := s.hubs[chatId]
+	if !ok {
+		h = newHub()
+		s.hubs[chatId] = h
+	}
+	return h
+}
+
+// lookup returns the chat's hub or nil if the chat has no hub
+func (r *registry) lookup(chatId string) *hub {
+	s := r.shard(chatId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hubs[chatId]
+}
+
+// cachedMember reports whether user is a cached member of the chat and whether members are cached.
+// If they aren't, the returned version is passed to cacheMembers after members are loaded
+func (r *registry) cachedMember(chatId, username string) (bool, bool, membersVersion) {
+	s := r.shard(chatId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version := membersVersion{hub: s.hubs[chatId], shardGeneration: s.generation}
+	if version.hub == nil {
+		return false, false, version
+	}
+	version.hub.mu.RLock()
+	defer version.hub.mu.RUnlock()
+	version.hubGeneration = version.hub.generation
+	return version.hub.members[username], version.hub.members != nil, version
+}
+
+// cacheMembers caches members loaded from the storage and reports whether user is a member.
+// Nothing is cached and false is returned as the second value if membership changed since the version
+func (r *registry) cacheMembers(chatId, username string, members []string, version membersVersion) (bool, bool) {
+	s := r.shard(chatId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != version.shardGeneration {
+		return false, false
+	}
+
+	//Hubs created after the version was taken haven't changed if their generation is zero
+	h := s.hub(chatId)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	expected := uint64(0)
+	if h == version.hub {
+		expected = version.hubGeneration
+	}
+	if h.generation != expected {
+		return false, false
+	}
+	h.setMembers(members)
+	return h.members[username], true
+}
+
+// setMembers replaces cached members of the chat creating its hub if needed
+func (r *registry) setMembers(chatId string, members []string) {
+	s := r.shard(chatId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.hub(chatId)
+	h.mu.Lock()
+	h.setMembers(members)
+	h.mu.Unlock()
+}
+
+// removeMember removes user from cached members of the chat and returns the chat's hub or nil if it has none
+func (r *registry) removeMember(chatId, username string) *hub {
+	s := r.shard(chatId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.hubs[chatId]
+	if h == nil {
+		s.generation++
+		return nil
+	}
+	h.mu.Lock()
+	delete(h.members, username)
+	h.generation++
+	h.mu.Unlock()
+	return h
+}
+
+// drop removes the chat's hub if it's still registered and idle
+func (r *registry) drop(chatId string, h *hub) {
+	s := r.shard(chatId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hubs[chatId] != h {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.idle() {
+		return
+	}
+	h.dropped = true
+	delete(s.hubs, chatId)
+	s.generation++
+}
+
+// shard returns the shard of the chat
+func (r *registry) shard(chatId string) *shard {
+	return &r.shards[shardIndex(chatId)]
+}
+
+// shardIndex spreads keys between shards by their hash
+func shardIndex(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32() % shardCount
+}
+
+// subscribe starts routing events of the chat to the client. Clients that have been removed
+// from the manager aren't subscribed again
+func (m *Manager) subscribe(client *Client, chatId string) {
+	//Lock order is client before hub, so removing the client can't miss a hub it's being added to
+	client.hubsMu.Lock()
+	defer client.hubsMu.Unlock()
+	if client.removed {
+		return
+	}
+	if client.hubs == nil {
+		client.hubs = make(map[string]*hub)
+	}
+
+	//Retry if the hub is dropped before the client is added
+	for {
+		h := m.hubs.hub(chatId)
+		h.mu.Lock()
+		if !h.dropped {
+			h.clients[client] = true
+			h.mu.Unlock()
+			client.hubs[chatId] = h
+			return
+		}
+		h.mu.Unlock()
+	}
+}
+
+// unsubscribe stops routing events of the chat to the client
+func (m *Manager) unsubscribe(client *Client, chatId string) {
+	client.hubsMu.Lock()
+	defer client.hubsMu.Unlock()
+
+	h, ok := client.hubs[chatId]
+	if !ok {
+		return
+	}
+	delete(client.hubs, chatId)
+	m.leave(client, chatId, h)
+}
+
+// unsubscribeAll unsubscribes removed client from all its chats and returns their ids
+func (m *Manager) unsubscribeAll(client *Client) []string {
+	client.hubsMu.Lock()
+	defer client.hubsMu.Unlock()
+
+	client.removed = true
+	chatIds := make([]string, 0, len(client.hubs))
+	for chatId, h := range client.hubs {
+		m.leave(client, chatId, h)
+		chatIds = append(chatIds, chatId)
+	}
+	client.hubs = nil
+	return chatIds
+}
+
+// leave removes client from the hub and drops the hub if it becomes idle
+func (m *Manager) leave(client *Client, chatId string, h *hub) {
+	h.mu.Lock()
+	delete(h.clients, client)
+	idle := h.idle()
+	h.mu.Unlock()
+	if idle {
+		m.hubs.drop(chatId, h)
+	}
+}
@@ -0,0 +1,118 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestHubs(t *testing.T) {
+	//Create manager with two chats
+	m, storage := newTestManager(t)
+	chat1, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	chat2, err := storage.NewChat(context.Background(), []string{"user1", "user3"}, "user1")
+	assert.NoError(t, err)
+	receiver := newTestClient(t, m, "user3")
+
+	//Hold the first chat's lock and check that events of the second chat are still routed
+	h := m.hubs.hub(chatIdHex(chat1))
+	h.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, m.broadcast(chatIdHex(chat2), EventTypingStart, Typing{ChatId: chatIdHex(chat2), From: "user1"}, nil))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast was blocked by another chat")
+	}
+	h.mu.Unlock()
+	assert.Equal(t, EventTypingStart, (<-receiver.writer).Type)
+
+	//Check that removing member unsubscribes only their clients
+	m.RemoveChatMember(chatIdHex(chat2), "user3")
+	assert.NoError(t, m.broadcast(chatIdHex(chat2), EventTypingStop, Typing{ChatId: chatIdHex(chat2), From: "user1"}, nil))
+	assert.Empty(t, receiver.writer)
+	assert.Empty(t, receiver.hubs)
+
+	//Connect, message and disconnect clients concurrently, the race detector checks hub locking
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &Client{username: "user1", manager: m, writer: make(chan Event, 16), logger: m.logger}
+			assert.NoError(t, m.AddClient(context.Background(), c))
+			m.handleEvent(context.Background(), c, testEvent(t, EventMessage, "", Message{ChatId: chatIdHex(chat1), Text: "hello"}))
+			m.AddChatClients(chatIdHex(chat2), []string{"user1"})
+			assert.NoError(t, m.RemoveClient(context.Background(), c))
+			assert.Empty(t, c.hubs)
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, m.hubs.hub(chatIdHex(chat1)).clients)
+}
+
+func TestDeliveryShards(t *testing.T) {
+	//Find users whose delivery state is in different shards
+	m, storage := newTestManager(t)
+	blocked := "user0"
+	var users []string
+	for i := 1; len(users) < 2; i++ {
+		username := fmt.Sprintf("user%d", i)
+		if shardIndex(username) != shardIndex(blocked) {
+			users = append(users, username)
+		}
+	}
+	chatId, err := storage.NewChat(context.Background(), users, users[0])
+	assert.NoError(t, err)
+	sender, receiver := newTestClient(t, m, users[0]), newTestClient(t, m, users[1])
+
+	//Hold delivery state of an unrelated user and check that the message is still delivered
+	d := m.deliveries.shard(blocked)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("delivery was blocked by another user")
+	}
+	assert.Equal(t, EventMessage, (<-receiver.writer).Type)
+}
+
+func TestHubLifetime(t *testing.T) {
+	//Create manager with a chat
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Check that messages to chats that don't exist don't create hubs
+	c := newTestClient(t, m, "user3")
+	missing := primitive.NewObjectID().Hex()
+	m.handleEvent(context.Background(), c, testEvent(t, EventMessage, "1", Message{ChatId: missing, Text: "spam"}))
+	assertErrorEvent(t, <-c.writer, "1", CodeNotFound)
+	assert.Nil(t, m.hubs.lookup(missing))
+
+	//Check that hub is dropped when its last client leaves and members aren't cached
+	c = newTestClient(t, m, "user1")
+	assert.NotNil(t, m.hubs.lookup(chatIdHex(chatId)))
+	assert.NoError(t, m.RemoveClient(context.Background(), c))
+	assert.Nil(t, m.hubs.lookup(chatIdHex(chatId)))
+
+	//Check that clients connecting after the hub is dropped get events of the chat
+	sender, receiver := newTestClient(t, m, "user1"), newTestClient(t, m, "user2")
+	m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, "2", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	assert.Equal(t, EventMessage, (<-receiver.writer).Type)
+}
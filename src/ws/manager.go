@@ -2,24 +2,86 @@ package ws
 
 import (
 	"context"
+	"errors"
+	"github.com/dafraer/messenger/src/broker"
 	"github.com/dafraer/messenger/src/store"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
+// ErrForbidden is returned when user isn't allowed to perform an action
+var ErrForbidden = errors.New("forbidden")
+
+// Default limits of the devices remembered for every user
+const (
+	DefaultMaxDevices = 10
+	DefaultDeviceTTL  = time.Hour * 24 * 30
+)
+
 // ClientList is a map holding list of clients
 type ClientList map[*Client]bool
 
 type Manager struct {
 	WSUpgrader websocket.Upgrader
-	clients    ClientList
-	mu         sync.RWMutex
-	logger     *zap.SugaredLogger
-	//chats field stores map of chats where client slice is stored as a value
-	chats map[string][]*Client
+	//SendBuffer is the size of the send queue of clients created after it's set
+	SendBuffer int
+	//Overflow is applied when a client's send queue is full
+	Overflow OverflowPolicy
+	//MaxFrameSize limits the size of a single frame read from a client
+	MaxFrameSize int
+	//MaxMessageSize limits the size of an event reassembled from chunks, see Chunk
+	MaxMessageSize int
+	//UserRateLimit and ChatRateLimit limit messages sent by a user and to a chat
+	UserRateLimit RateLimit
+	ChatRateLimit RateLimit
+	//MaxViolations is the number of rate limited messages in a row after which a client is disconnected, zero disables it
+	MaxViolations int
+	//limiter stores token buckets of users and chats
+	limiter limiter
+	//MaxDevices limits the number of devices whose pending messages are kept for a user, zero disables it
+	MaxDevices int
+	//DeviceTTL is how long devices without connected clients are remembered, zero keeps them until eviction
+	DeviceTTL time.Duration
+	//mu guards clients, ids, online, remote, handlers and methods
+	clients ClientList
+	//ids stores clients by id
+	ids    map[string]*Client
+	mu     sync.RWMutex
+	logger *zap.SugaredLogger
+	//hubs routes events of every chat to its subscribed clients, see hub
+	hubs  registry
 	store store.Storer
+	//handlers stores event handlers by event type
+	handlers map[string]EventHandler
+	//methods stores methods of request events by name
+	methods map[string]Method
+	//deliveries stores devices, pending messages and delivery state of users. Its shards are locked before any hub lock
+	deliveries deliveries
+	//online stores number of connected clients by username
+	online map[string]int
+	//remote stores ids of other managers the user is connected to by username, see updatePresence
+	remote map[string]map[string]bool
+	//metrics counts events sent to clients
+	metrics metrics
+	//broker relays events to other managers, it's nil when the server runs as a single instance
+	broker broker.Broker
+	//id identifies the manager among managers connected to the broker
+	id string
+	//watching is set while messages are watched, local stores expiry times of changes already sent, see claim
+	watching   atomic.Bool
+	local      map[string]time.Time
+	localSwept time.Time
+	localMu    sync.Mutex
+	//sending counts messages being saved by chat and sender, sent is signalled when one of them is claimed, see startSending
+	sending map[string]int
+	sent    *sync.Cond
+	//watchBackoff is the initial delay before the stream is restarted after it fails
+	watchBackoff time.Duration
 }
 
 // NewManager creates new websocket manager
@@ -28,32 +90,77 @@ func NewManager(logger *zap.SugaredLogger, store store.Storer) *Manager {
 		WSUpgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
+			//Write buffers are shared by idle connections
+			WriteBufferPool: &sync.Pool{},
+			//Negotiate permessage-deflate with clients that support it
+			EnableCompression: true,
+			Subprotocols:      Subprotocols(),
 		},
-		clients: make(ClientList),
-		mu:      sync.RWMutex{},
-		logger:  logger,
-		store:   store,
-		chats:   make(map[string][]*Client),
+		SendBuffer:     DefaultSendBuffer,
+		Overflow:       OverflowDropOldest,
+		MaxFrameSize:   DefaultMaxFrameSize,
+		MaxMessageSize: DefaultMaxMessageSize,
+		UserRateLimit:  DefaultUserRateLimit,
+		ChatRateLimit:  DefaultChatRateLimit,
+		MaxViolations:  DefaultMaxViolations,
+		MaxDevices:     DefaultMaxDevices,
+		DeviceTTL:      DefaultDeviceTTL,
+		clients:        make(ClientList),
+		ids:            make(map[string]*Client),
+		mu:             sync.RWMutex{},
+		logger:         logger,
+		store:          store,
+		handlers:       make(map[string]EventHandler),
+		methods:        make(map[string]Method),
+		online:         make(map[string]int),
+		remote:         make(map[string]map[string]bool),
+		id:             newId(),
+		local:          make(map[string]time.Time),
+		sending:        make(map[string]int),
+		watchBackoff:   time.Second,
 	}
+	m.sent = sync.NewCond(&m.localMu)
+	m.registerDefaultHandlers()
+	m.registerDefaultMethods()
 	return m
 }
 
-// AddClient adds new client to the websocket manager
+// AddClient adds new client to the websocket manager. Users who share a chat with the client's user
+// are notified when the user comes online
 func (m *Manager) AddClient(ctx context.Context, client *Client) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
 	//Get user chats
 	chats, err := m.store.GetChats(ctx, client.username)
 	if err != nil {
 		return err
 	}
+	chatIds := make([]string, len(chats))
+	for i, chat := range chats {
+		chatIds[i] = chat.Id
+	}
 
+	m.mu.Lock()
 	//Add clients to the client list
 	m.clients[client] = true
+	if client.id != "" {
+		m.ids[client.id] = client
+	}
+	m.online[client.username]++
+	cameOnline := m.online[client.username] == 1
+	m.mu.Unlock()
+
+	//Register device and subscribe client under the lock of the user's delivery state so
+	//messages delivered meanwhile are either replayed or sent, never both or none
+	d := m.deliveries.shard(client.username)
+	d.mu.Lock()
+	//Redeliver messages the device hasn't acknowledged before it reconnected
+	client.replay = d.registerDevice(client, m.MaxDevices, m.DeviceTTL, time.Now())
+	for _, chatId := range chatIds {
+		m.subscribe(client, chatId)
+	}
+	d.mu.Unlock()
 
-	//add all user chats to the manager
-	for _, chat := range chats {
-		m.chats[chat.Id] = append(m.chats[chat.Id], client)
+	if cameOnline {
+		m.notifyPresence(Presence{Username: client.username, Online: true}, chatIds)
 	}
 	return nil
 }
@@ -61,67 +168,192 @@ func (m *Manager) AddClient(ctx context.Context, client *Client) error {
 // AddChatClients registers all currently connected members of a newly created chat
 // so messages are routed without waiting for a reconnect.
 func (m *Manager) AddChatClients(chatId string, members []string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	if err := m.dispatch(envelope{Route: routeMembers, ChatIds: []string{chatId}, Members: members}, nil); err != nil {
+		m.logger.Errorw("Error adding chat clients", "error", err)
+	}
+}
+
+// addChatClients caches members of the chat and subscribes their clients connected to this manager
+func (m *Manager) addChatClients(chatId string, members []string) {
+	//Cache chat members
+	m.hubs.setMembers(chatId, members)
+
+	//Snapshot connected clients of the members
+	m.mu.RLock()
+	var clients []*Client
 	for client := range m.clients {
-		for _, member := range members {
-			if client.username != member {
-				continue
-			}
-			already := false
-			for _, existing := range m.chats[chatId] {
-				if existing == client {
-					already = true
-					break
-				}
-			}
-			if !already {
-				m.chats[chatId] = append(m.chats[chatId], client)
-			}
+		if slices.Contains(members, client.username) {
+			clients = append(clients, client)
 		}
 	}
+	m.mu.RUnlock()
+
+	for _, client := range clients {
+		m.subscribe(client, chatId)
+	}
 }
 
-// RemoveClient removes websocket client from the manager and closes the connection
+// RemoveClient removes client from the manager and closes the connection.
+// When user's last client is removed the last seen time is saved and users who share a chat are notified
 func (m *Manager) RemoveClient(ctx context.Context, client *Client) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	//Unsubscribe client from its chats
+	chatIds := m.unsubscribeAll(client)
 
-	//Get user chats
-	chats, err := m.store.GetChats(ctx, client.username)
-	if err != nil {
-		return err
+	m.mu.Lock()
+	_, ok := m.clients[client]
+	wentOffline := false
+	if ok {
+		delete(m.clients, client)
+		delete(m.ids, client.id)
+		m.online[client.username]--
+		if m.online[client.username] == 0 {
+			delete(m.online, client.username)
+			wentOffline = true
+		}
 	}
+	m.mu.Unlock()
 
-	//remove user from chats
-	//Iterate through user chats
-	for _, chat := range chats {
-		//Iterate through chat's clients to delete this client from there
-		for i, c := range m.chats[chat.Id] {
-			//If we found our user delete them
-			if c == client {
-				if i < len(m.chats[chat.Id])-1 {
-					m.chats[chat.Id] = append(m.chats[chat.Id][:i], m.chats[chat.Id][i+1:]...)
-				} else {
-					m.chats[chat.Id] = m.chats[chat.Id][:i]
-				}
-				//If chat has no clients connected set it to nil
-				if len(m.chats[chat.Id]) == 0 {
-					delete(m.chats, chat.Id)
-				}
-			}
-		}
+	//Note that the device disconnected, so it expires once it stays idle
+	if ok {
+		d := m.deliveries.shard(client.username)
+		d.mu.Lock()
+		d.unregisterDevice(client.deviceKey(), time.Now())
+		d.mu.Unlock()
 	}
 
-	//Check if client exists then delete it
-	if _, ok := m.clients[client]; ok {
-		//Close connection
-		if err := client.connection.Close(); err != nil {
+	//Close connection
+	if ok {
+		if err := client.close(); err != nil {
 			m.logger.Errorw("Error removing websocket client", "error", err)
 			return err
 		}
-		//Remove client
-		delete(m.clients, client)
 	}
+	if !wentOffline {
+		return nil
+	}
+
+	//Save last seen time and notify users who share a chat
+	presence := Presence{Username: client.username, LastSeen: now()}
+	if err := m.store.SetLastSeen(ctx, client.username, presence.LastSeen); err != nil {
+		m.logger.Errorw("Error saving last seen time", "error", err)
+	}
+	m.notifyPresence(presence, chatIds)
 	return nil
 }
+
+// EditMessage replaces text of a message and notifies connected chat members.
+// Only the author who is still a member of the chat may edit the message
+func (m *Manager) EditMessage(ctx context.Context, username, chatId, messageId, text string) (*store.Message, error) {
+	//Check that user is a member of the chat
+	member, err := m.isMember(ctx, chatId, username)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, ErrForbidden
+	}
+
+	//Check that user is the author and message wasn't deleted
+	msg, err := m.store.GetMessage(ctx, chatId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	if msg.From != username {
+		return nil, ErrForbidden
+	}
+	if msg.DeletedAt != 0 {
+		return nil, store.ErrNotFound
+	}
+
+	//Edit message
+	edited, err := m.store.EditMessage(ctx, chatId, messageId, text, now())
+	if err != nil {
+		return nil, err
+	}
+
+	//Notify everyone in the chat including the author's other connections
+	if m.claim(store.ChangeEdit, newMessage(edited)) {
+		if err := m.broadcast(chatId, EventEdit, newMessage(edited), nil); err != nil {
+			return nil, err
+		}
+	}
+	return edited, nil
+}
+
+// DeleteMessage deletes message for everyone and notifies connected chat members.
+// Authors can delete their own messages and chat owners can delete any message in their chat
+func (m *Manager) DeleteMessage(ctx context.Context, username, chatId, messageId string) (*store.Message, error) {
+	//Get chat and message to check permissions
+	chat, err := m.store.GetChat(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := m.store.GetMessage(ctx, chatId, messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	//Only the author who is still a member or the chat owner may delete the message
+	isAuthor := msg.From == username && slices.Contains(chat.Members, username)
+	if !isAuthor && chat.Owner != username {
+		return nil, ErrForbidden
+	}
+
+	//Delete message
+	deleted, err := m.store.DeleteMessage(ctx, chatId, messageId, now())
+	if err != nil {
+		return nil, err
+	}
+
+	//Notify everyone in the chat so they drop the message text
+	if m.claim(store.ChangeDelete, newMessage(deleted)) {
+		if err := m.broadcast(chatId, EventDelete, newMessage(deleted), nil); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
+
+// HideMessage deletes message only for the user and notifies the user's other connections
+func (m *Manager) HideMessage(ctx context.Context, username, chatId, messageId string) error {
+	//Check that user is a member of the chat
+	member, err := m.isMember(ctx, chatId, username)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return ErrForbidden
+	}
+
+	//Hide message
+	if err := m.store.HideMessage(ctx, chatId, messageId, username); err != nil {
+		return err
+	}
+
+	//Notify user's connections
+	return m.sendToUser(username, EventHide, Message{Id: messageId, ChatId: chatId})
+}
+
+// sendToUser sends event to all connections of the user that are subscribed to the chat
+func (m *Manager) sendToUser(username, eventType string, message Message) error {
+	event, err := newEvent(eventType, message)
+	if err != nil {
+		return err
+	}
+	return m.dispatch(envelope{Route: routeUser, ChatIds: []string{message.ChatId}, Username: username, Event: event}, nil)
+}
+
+// broadcast sends event to all clients connected to the chat except the sender
+func (m *Manager) broadcast(chatId, eventType string, payload any, sender *Client) error {
+	//Marshal payload once for all recipients
+	event, err := newEvent(eventType, payload)
+	if err != nil {
+		return err
+	}
+	return m.dispatch(envelope{Route: routeChat, ChatIds: []string{chatId}, Event: event}, sender)
+}
+
+// now returns current unix utc time
+func now() int64 {
+	return time.Now().UTC().Unix()
+}
@@ -0,0 +1,65 @@
+package ws
+
+import (
+	"context"
+	"slices"
+)
+
+// isMember reports whether user is a member of the chat. Members are loaded from the storage
+// on the first request and cached in the chat's hub until membership of the chat changes.
+// Hubs are created only for chats that exist, so unknown chat ids don't take memory
+func (m *Manager) isMember(ctx context.Context, chatId, username string) (bool, error) {
+	for {
+		//Check the cache
+		member, loaded, version := m.hubs.cachedMember(chatId, username)
+		if loaded {
+			return member, nil
+		}
+
+		//Load chat members outside the lock
+		chat, err := m.store.GetChat(ctx, chatId)
+		if err != nil {
+			return false, err
+		}
+
+		//Cache members unless membership changed while they were loading, then they may be stale and are loaded again
+		if member, ok := m.hubs.cacheMembers(chatId, username, chat.Members, version); ok {
+			return member, nil
+		}
+	}
+}
+
+// isMemberFresh reports whether user is a member of the chat checking the storage instead of the cache.
+// Cached members are updated by this manager and the broker only, so they may still list users
+// removed while the manager wasn't told about it. Access to stored data uses this check
+func (m *Manager) isMemberFresh(ctx context.Context, chatId, username string) (bool, error) {
+	chat, err := m.store.GetChat(ctx, chatId)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(chat.Members, username), nil
+}
+
+// RemoveChatMember updates cached members after user has been removed from the chat
+// and stops routing chat events to the user's connections
+func (m *Manager) RemoveChatMember(chatId, username string) {
+	if err := m.dispatch(envelope{Route: routeRemoveMember, ChatIds: []string{chatId}, Username: username}, nil); err != nil {
+		m.logger.Errorw("Error removing chat member", "error", err)
+	}
+}
+
+// removeChatMember removes user from cached members of the chat and unsubscribes the user's clients connected to this manager
+func (m *Manager) removeChatMember(chatId, username string) {
+	//Update the cache, members being loaded meanwhile are loaded again
+	h := m.hubs.removeMember(chatId, username)
+	if h == nil {
+		return
+	}
+
+	//Unsubscribe user's clients from the chat
+	for _, client := range h.snapshot() {
+		if client.username == username {
+			m.unsubscribe(client, chatId)
+		}
+	}
+}
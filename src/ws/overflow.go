@@ -0,0 +1,125 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// DefaultSendBuffer is the default number of events queued for a client before the overflow policy applies
+const DefaultSendBuffer = 256
+
+// OverflowPolicy decides what happens when a client's send queue is full
+type OverflowPolicy int
+
+const (
+	//OverflowDropOldest drops the oldest queued event to make room for the new one.
+	//Dropped messages stay in the device's pending queue and are redelivered on reconnect
+	OverflowDropOldest OverflowPolicy = iota
+	//OverflowDisconnect disconnects the slow client, it gets missed messages when it reconnects
+	OverflowDisconnect
+)
+
+// ParseOverflowPolicy parses overflow policy name, drop_oldest or disconnect
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "drop_oldest":
+		return OverflowDropOldest, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// Metrics counts events sent to clients
+type Metrics struct {
+	//Queued is the number of events put into client queues
+	Queued int64 `json:"queued"`
+	//Dropped is the number of events dropped because a client queue was full
+	Dropped int64 `json:"dropped"`
+	//Disconnected is the number of slow clients that were disconnected
+	Disconnected int64 `json:"disconnected"`
+	//Pending is the number of events currently waiting in client queues
+	Pending int64 `json:"pending"`
+	//Limited is the number of messages refused by rate limits
+	Limited int64 `json:"limited"`
+	//Abusive is the number of clients disconnected for exceeding rate limits repeatedly
+	Abusive int64 `json:"abusive"`
+}
+
+// metrics stores counters updated by clients without locking
+type metrics struct {
+	queued       atomic.Int64
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+	limited      atomic.Int64
+	abusive      atomic.Int64
+}
+
+// Metrics returns current counters of the events sent to clients
+func (m *Manager) Metrics() Metrics {
+	metrics := Metrics{
+		Queued:       m.metrics.queued.Load(),
+		Dropped:      m.metrics.dropped.Load(),
+		Disconnected: m.metrics.disconnected.Load(),
+		Limited:      m.metrics.limited.Load(),
+		Abusive:      m.metrics.abusive.Load(),
+	}
+
+	m.mu.RLock()
+	for client := range m.clients {
+		metrics.Pending += int64(len(client.writer))
+	}
+	m.mu.RUnlock()
+	return metrics
+}
+
+// send queues event to be written to the websocket connection without blocking.
+// If the queue is full the manager's overflow policy applies
+func (c *Client) send(event Event) {
+	//Skip events the client doesn't handle
+	if !c.accepted(event.Type) {
+		return
+	}
+
+	for {
+		select {
+		case c.writer <- event:
+			c.manager.metrics.queued.Add(1)
+			return
+		default:
+		}
+
+		//Queue is full
+		if c.manager.Overflow == OverflowDisconnect {
+			c.manager.metrics.dropped.Add(1)
+			if c.disconnect("send queue is full") {
+				c.manager.metrics.disconnected.Add(1)
+			}
+			return
+		}
+
+		//Drop the oldest event and try again, the writer may have freed space meanwhile
+		select {
+		case <-c.writer:
+			c.manager.metrics.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// disconnect removes slow or abusive client from the manager once. It reports whether this call disconnected the client
+func (c *Client) disconnect(reason string) bool {
+	if !c.closing.CompareAndSwap(false, true) {
+		return false
+	}
+	c.logger.Infow("Disconnecting client", "username", c.username, "device", c.device, "reason", reason)
+
+	//Remove client in a separate goroutine so the sender isn't blocked
+	go func() {
+		if err := c.manager.RemoveClient(context.Background(), c); err != nil {
+			c.logger.Errorw("Error removing client", "error", err)
+		}
+	}()
+	return true
+}
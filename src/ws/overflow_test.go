@@ -0,0 +1,38 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverflow(t *testing.T) {
+	//Create manager and a client with a small queue that never reads it
+	m, _ := newTestManager(t)
+	c := &Client{username: "user1", manager: m, writer: make(chan Event, 2), logger: m.logger}
+	assert.NoError(t, m.AddClient(context.Background(), c))
+
+	//Overflow the queue and check that the oldest events are dropped
+	for _, id := range []string{"1", "2", "3"} {
+		c.send(Event{Type: EventMessage, Id: id})
+	}
+	assert.Equal(t, "2", (<-c.writer).Id)
+	assert.Equal(t, "3", (<-c.writer).Id)
+	assert.Equal(t, Metrics{Queued: 3, Dropped: 1}, m.Metrics())
+
+	//Overflow the queue with the disconnect policy and check that client is removed
+	m.Overflow = OverflowDisconnect
+	for _, id := range []string{"4", "5", "6", "7"} {
+		c.send(Event{Type: EventMessage, Id: id})
+	}
+	assert.Eventually(t, func() bool {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return !m.clients[c]
+	}, time.Second, time.Millisecond*10)
+	metrics := m.Metrics()
+	assert.Equal(t, int64(3), metrics.Dropped)
+	assert.Equal(t, int64(1), metrics.Disconnected)
+}
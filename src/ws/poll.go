@@ -0,0 +1,115 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// pollIdleTimeout is how long a long-poll client stays registered without polling.
+// Events queued meanwhile are kept, unacknowledged messages are still redelivered after it expires
+var pollIdleTimeout = time.Minute
+
+// maxPollEvents is the maximum number of events returned by a single poll
+const maxPollEvents = 100
+
+// ErrPollInProgress is returned when a long-poll client polls again before its previous poll returned
+var ErrPollInProgress = errors.New("poll in progress")
+
+// pollState is the state of a long-poll client kept between polls
+type pollState struct {
+	//mu is held while the client polls
+	mu sync.Mutex
+	//idle removes the client when it doesn't poll for pollIdleTimeout
+	idle *time.Timer
+	//greeting stores connected and hello events returned before any other events by the first poll
+	greeting []Event
+}
+
+// NewPollClient creates new client for devices that can't keep a connection open. Events are queued
+// until the device polls them, see Poll, and the first poll gets connected event carrying the client id and hello event.
+// Events from the device are sent with separate requests, see ReceiveEvent
+func NewPollClient(manager *Manager, username, device string) (*Client, error) {
+	c := &Client{
+		id:       newId(),
+		username: username,
+		device:   device,
+		done:     make(chan struct{}),
+		manager:  manager,
+		writer:   make(chan Event, manager.SendBuffer),
+		logger:   manager.logger,
+		poll:     &pollState{},
+	}
+	events, err := c.greeting()
+	if err != nil {
+		return nil, err
+	}
+	c.poll.greeting = events
+	c.poll.idle = time.AfterFunc(pollIdleTimeout, c.expire)
+	return c, nil
+}
+
+// Poll returns events queued for a client created by NewPollClient. If there are none it waits until an event
+// arrives, ctx is done or timeout elapses. The first poll starts with connected and hello events,
+// then events missed before the reconnect are returned
+func (c *Client) Poll(ctx context.Context, timeout time.Duration) ([]Event, error) {
+	if c.poll == nil {
+		return nil, ErrClientNotFound
+	}
+	if !c.poll.mu.TryLock() {
+		return nil, ErrPollInProgress
+	}
+	defer c.poll.mu.Unlock()
+
+	//Don't expire the client while it's polling
+	c.poll.idle.Stop()
+	defer c.poll.idle.Reset(pollIdleTimeout)
+
+	//Check that the client wasn't removed
+	select {
+	case <-c.done:
+		return nil, ErrClientNotFound
+	default:
+	}
+
+	//Return the greeting first, so the device learns the client id however many events are missed.
+	//Then return events that were missed or weren't acknowledged before the reconnect
+	events := c.poll.greeting
+	c.poll.greeting = nil
+	for len(c.replay) > 0 && len(events) < maxPollEvents {
+		events = append(events, c.replay[0].event)
+		c.replay = c.replay[1:]
+	}
+
+	//Wait for the first event if nothing is queued
+	if len(events) == 0 && len(c.writer) == 0 && timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case event := <-c.writer:
+			events = append(events, event)
+		case <-timer.C:
+		case <-ctx.Done():
+		case <-c.done:
+		}
+	}
+
+	//Take the rest of queued events without waiting
+	for len(events) < maxPollEvents {
+		select {
+		case event := <-c.writer:
+			events = append(events, event)
+		default:
+			return events, nil
+		}
+	}
+	return events, nil
+}
+
+// expire removes long-poll client that stopped polling
+func (c *Client) expire() {
+	if err := c.manager.RemoveClient(context.Background(), c); err != nil {
+		c.logger.Errorw("Error removing client", "error", err)
+	}
+}
@@ -0,0 +1,97 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoll(t *testing.T) {
+	//Expire idle clients quickly
+	defer func(timeout time.Duration) { pollIdleTimeout = timeout }(pollIdleTimeout)
+	pollIdleTimeout = time.Millisecond * 200
+
+	//Create manager and connect long-poll client
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	c, err := NewPollClient(m, "user2", "device")
+	assert.NoError(t, err)
+	assert.NoError(t, m.AddClient(context.Background(), c))
+	sender := newTestClient(t, m, "user1")
+
+	//Check that the first poll returns connected and hello events without waiting
+	events, err := c.Poll(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, EventConnected, events[0].Type)
+	assert.Equal(t, EventHello, events[1].Type)
+	var connected Connected
+	assert.NoError(t, json.Unmarshal(events[0].Payload, &connected))
+	found, err := m.Client("user2", connected.ClientId)
+	assert.NoError(t, err)
+	assert.Equal(t, c, found)
+
+	//Check that poll waits for a message
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	}()
+	events, err = c.Poll(context.Background(), time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, EventMessage, events[0].Type)
+
+	//Check that poll returns nothing after the timeout
+	events, err = c.Poll(context.Background(), time.Millisecond*50)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	//Check that concurrent polls are refused
+	c.poll.mu.Lock()
+	_, err = c.Poll(context.Background(), 0)
+	assert.ErrorIs(t, err, ErrPollInProgress)
+	c.poll.mu.Unlock()
+
+	//Check that client that stopped polling is removed
+	assert.Eventually(t, func() bool {
+		_, err := m.Client("user2", connected.ClientId)
+		return err == ErrClientNotFound
+	}, time.Second, time.Millisecond*10)
+	_, err = c.Poll(context.Background(), 0)
+	assert.ErrorIs(t, err, ErrClientNotFound)
+}
+
+func TestPollReplay(t *testing.T) {
+	//Create manager and queue more messages than a poll returns for an offline device
+	m, storage := newTestManager(t)
+	m.UserRateLimit, m.ChatRateLimit = RateLimit{}, RateLimit{}
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	assert.NoError(t, m.RemoveClient(context.Background(), newTestDevice(t, m, "user2", "device")))
+	sender := newTestClient(t, m, "user1")
+	for range maxPollEvents + 10 {
+		m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+		<-sender.writer
+	}
+
+	//Connect long-poll client of the device and check that the first poll starts with the greeting
+	c, err := NewPollClient(m, "user2", "device")
+	assert.NoError(t, err)
+	assert.NoError(t, m.AddClient(context.Background(), c))
+	events, err := c.Poll(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Len(t, events, maxPollEvents)
+	assert.Equal(t, EventConnected, events[0].Type)
+	assert.Equal(t, EventHello, events[1].Type)
+	assert.Equal(t, EventMessage, events[2].Type)
+
+	//Check that the next poll returns the rest of the messages
+	events, err = c.Poll(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Len(t, events, 12)
+	assert.NoError(t, m.RemoveClient(context.Background(), c))
+}
@@ -0,0 +1,123 @@
+package ws
+
+import (
+	"context"
+)
+
+// Presence is the payload of presence events and the presence of a user returned by Presence
+type Presence struct {
+	Username string `json:"username"`
+	Online   bool   `json:"online"`
+	//LastSeen is unix utc time when user was last online, it is 0 for users who are online or have never been online
+	LastSeen int64 `json:"last_seen,omitempty"`
+}
+
+// Presence returns presence of the users as seen by the viewer. Users are online while they have at least
+// one connected client. Only the viewer and users who share a chat with the viewer are visible,
+// other users are returned as offline users who have never been online
+func (m *Manager) Presence(ctx context.Context, viewer string, usernames []string) ([]Presence, error) {
+	//Get users who share a chat with the viewer
+	chats, err := m.store.GetChats(ctx, viewer)
+	if err != nil {
+		return nil, err
+	}
+	visible := map[string]bool{viewer: true}
+	for _, chat := range chats {
+		for _, member := range chat.Members {
+			visible[member] = true
+		}
+	}
+
+	//Get online users
+	presence := make([]Presence, len(usernames))
+	var offline []string
+	m.mu.RLock()
+	for i, username := range usernames {
+		presence[i] = Presence{Username: username, Online: visible[username] && m.isOnline(username)}
+		if !presence[i].Online && visible[username] {
+			offline = append(offline, username)
+		}
+	}
+	m.mu.RUnlock()
+
+	//Get last seen time of offline users
+	if len(offline) == 0 {
+		return presence, nil
+	}
+	lastSeen, err := m.store.GetLastSeen(ctx, offline)
+	if err != nil {
+		return nil, err
+	}
+	for i := range presence {
+		if !presence[i].Online && visible[presence[i].Username] {
+			presence[i].LastSeen = lastSeen[presence[i].Username]
+		}
+	}
+	return presence, nil
+}
+
+// notifyPresence sends presence event to connected users who share a chat with the user
+func (m *Manager) notifyPresence(presence Presence, chatIds []string) {
+	event, err := newEvent(EventPresence, presence)
+	if err != nil {
+		m.logger.Errorw("Error creating presence event", "error", err)
+		return
+	}
+
+	//Send event once to every client except the user's own ones
+	if err := m.dispatch(envelope{Route: routePresence, ChatIds: chatIds, Username: presence.Username, Event: event}, nil); err != nil {
+		m.logger.Errorw("Error sending presence event", "error", err)
+	}
+}
+
+// isOnline reports whether the user has clients connected to this or another manager. Must be called with mu held
+func (m *Manager) isOnline(username string) bool {
+	return m.online[username] > 0 || len(m.remote[username]) > 0
+}
+
+// updatePresence records presence of the user on the manager the change came from, origin is empty for this manager.
+// It reports whether the change is visible to others, users are online while connected to any manager
+func (m *Manager) updatePresence(origin string, presence Presence) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	//Local changes are recorded by AddClient and RemoveClient, they are hidden while the user is connected elsewhere
+	if origin == "" || origin == m.id {
+		return len(m.remote[presence.Username]) == 0
+	}
+
+	wasOnline := m.isOnline(presence.Username)
+	if presence.Online {
+		if m.remote[presence.Username] == nil {
+			m.remote[presence.Username] = make(map[string]bool)
+		}
+		m.remote[presence.Username][origin] = true
+	} else {
+		delete(m.remote[presence.Username], origin)
+		if len(m.remote[presence.Username]) == 0 {
+			delete(m.remote, presence.Username)
+		}
+	}
+	return wasOnline != m.isOnline(presence.Username)
+}
+
+// announcePresence tells other managers which users are connected to this manager
+func (m *Manager) announcePresence() {
+	m.mu.RLock()
+	usernames := make([]string, 0, len(m.online))
+	for username := range m.online {
+		usernames = append(usernames, username)
+	}
+	m.mu.RUnlock()
+
+	for _, username := range usernames {
+		event, err := newEvent(EventPresence, Presence{Username: username, Online: true})
+		if err != nil {
+			m.logger.Errorw("Error creating presence event", "error", err)
+			return
+		}
+		if err := m.publish(envelope{Route: routePresence, Username: username, Event: event}); err != nil {
+			m.logger.Errorw("Error announcing presence", "error", err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresence(t *testing.T) {
+	//Create manager with in-memory storage
+	m, storage := newTestManager(t)
+	assert.NoError(t, storage.NewUser(context.Background(), "user2", "password"))
+	_, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	watcher := newTestClient(t, m, "user1")
+
+	//Connect two devices of the user and check that user comes online once
+	phone := &Client{username: "user2", device: "phone", manager: m, writer: make(chan Event, 16), logger: m.logger}
+	laptop := &Client{username: "user2", device: "laptop", manager: m, writer: make(chan Event, 16), logger: m.logger}
+	assert.NoError(t, m.AddClient(context.Background(), phone))
+	assert.NoError(t, m.AddClient(context.Background(), laptop))
+	assert.Equal(t, Presence{Username: "user2", Online: true}, presencePayload(t, <-watcher.writer))
+	assert.Empty(t, watcher.writer)
+
+	//Disconnect both devices and check that user goes offline with last seen time
+	assert.NoError(t, m.RemoveClient(context.Background(), phone))
+	assert.Empty(t, watcher.writer)
+	assert.NoError(t, m.RemoveClient(context.Background(), laptop))
+	offline := presencePayload(t, <-watcher.writer)
+	assert.False(t, offline.Online)
+	assert.NotZero(t, offline.LastSeen)
+
+	//Check that removing the client twice doesn't send presence again
+	assert.NoError(t, m.RemoveClient(context.Background(), laptop))
+	assert.Empty(t, watcher.writer)
+
+	//Check presence of online, offline and unknown users
+	presence, err := m.Presence(context.Background(), "user1", []string{"user1", "user2", "user3"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Presence{
+		{Username: "user1", Online: true},
+		{Username: "user2", LastSeen: offline.LastSeen},
+		{Username: "user3"},
+	}, presence)
+
+	//Check that a user who shares no chat with the viewer is shown as unknown while online
+	newTestClient(t, m, "user3")
+	presence, err = m.Presence(context.Background(), "user2", []string{"user1", "user3"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Presence{{Username: "user1", Online: true}, {Username: "user3"}}, presence)
+}
+
+// presencePayload checks that event is a presence event and returns its payload
+func presencePayload(t *testing.T, event Event) Presence {
+	assert.Equal(t, EventPresence, event.Type)
+	var presence Presence
+	assert.NoError(t, json.Unmarshal(event.Payload, &presence))
+	return presence
+}
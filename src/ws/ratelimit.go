@@ -0,0 +1,168 @@
+package ws
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default rate limits of message sends
+var (
+	//DefaultUserRateLimit limits messages sent by a user from all devices
+	DefaultUserRateLimit = RateLimit{Rate: 5, Burst: 20}
+	//DefaultChatRateLimit limits messages sent to a chat by all its members
+	DefaultChatRateLimit = RateLimit{Rate: 20, Burst: 50}
+)
+
+// DefaultMaxViolations is the default number of rate limited messages in a row after which a client is disconnected
+const DefaultMaxViolations = 10
+
+// sweepInterval is how often buckets that have refilled are removed
+const sweepInterval = time.Minute
+
+// RateLimit configures a token bucket. The bucket holds up to Burst tokens and gets Rate tokens every second,
+// every event takes a token. Zero rate disables the limit
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses rate limit written as rate:burst, for example 5:20. Rate limit "off" is disabled
+func ParseRateLimit(value string) (RateLimit, error) {
+	if value == "off" {
+		return RateLimit{}, nil
+	}
+	rateValue, burstValue, ok := strings.Cut(value, ":")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected rate:burst", value)
+	}
+	rate, err := strconv.ParseFloat(rateValue, 64)
+	if err != nil || rate <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate in rate limit %q", value)
+	}
+	burst, err := strconv.Atoi(burstValue)
+	if err != nil || burst < 1 {
+		return RateLimit{}, fmt.Errorf("invalid burst in rate limit %q", value)
+	}
+	return RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+// SlowDownError is returned when a client sends events faster than rate limits allow
+type SlowDownError struct {
+	//RetryAfter is the time until the event can be sent again
+	RetryAfter time.Duration
+}
+
+func (e *SlowDownError) Error() string {
+	return fmt.Sprintf("slow down, retry after %v", e.RetryAfter)
+}
+
+// bucket is a token bucket of a user or a chat
+type bucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds tokens accumulated since the last update
+func (b *bucket) refill(now time.Time) {
+	b.tokens = min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate)
+	b.updated = now
+}
+
+// limitKey is a bucket key with the limit of the bucket
+type limitKey struct {
+	key   string
+	limit RateLimit
+}
+
+// limiter stores token buckets by key
+type limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// take takes a token from every bucket if all of them have one and returns zero.
+// Otherwise no tokens are taken and the time until all buckets have a token is returned with keys of the empty buckets
+func (l *limiter) take(now time.Time, keys ...limitKey) (time.Duration, []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	l.sweep(now)
+
+	//Refill buckets and find the longest wait
+	buckets := make([]*bucket, 0, len(keys))
+	var wait time.Duration
+	var empty []string
+	for _, key := range keys {
+		if key.limit.Rate <= 0 {
+			continue
+		}
+		b, ok := l.buckets[key.key]
+		if !ok || b.limit != key.limit {
+			b = &bucket{limit: key.limit, tokens: float64(key.limit.Burst), updated: now}
+			l.buckets[key.key] = b
+		}
+		b.refill(now)
+		if b.tokens < 1 {
+			wait = max(wait, time.Duration(math.Ceil((1-b.tokens)/b.limit.Rate*float64(time.Second))))
+			empty = append(empty, key.key)
+		}
+		buckets = append(buckets, b)
+	}
+	if wait > 0 {
+		return wait, empty
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, nil
+}
+
+// sweep removes buckets that have refilled since they are the same as new ones. Must be called with mu held
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// limit takes tokens of the user and the chat for a message. Clients that keep sending
+// after being told to slow down by their user's limit MaxViolations times in a row are disconnected.
+// Busy chats only slow their members down, so one user can't get others disconnected by filling the chat's bucket
+func (m *Manager) limit(c *Client, chatId string) error {
+	user := "user:" + c.username
+	wait, empty := m.limiter.take(time.Now(),
+		limitKey{key: user, limit: m.UserRateLimit},
+		limitKey{key: "chat:" + chatId, limit: m.ChatRateLimit},
+	)
+	if wait == 0 {
+		c.violations.Store(0)
+		return nil
+	}
+
+	//Only the user's own limit counts as a violation
+	m.metrics.limited.Add(1)
+	if !slices.Contains(empty, user) || m.MaxViolations <= 0 {
+		return &SlowDownError{RetryAfter: wait}
+	}
+	if int(c.violations.Add(1)) >= m.MaxViolations && c.disconnect("rate limits exceeded") {
+		m.metrics.abusive.Add(1)
+	}
+	return &SlowDownError{RetryAfter: wait}
+}
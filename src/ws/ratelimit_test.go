@@ -0,0 +1,119 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	var l limiter
+	start := time.Now()
+	user := limitKey{key: "user:user1", limit: RateLimit{Rate: 1, Burst: 2}}
+	chat := limitKey{key: "chat:1", limit: RateLimit{Rate: 10, Burst: 3}}
+
+	//Check that the burst is allowed and the next event has to wait for a token of the empty bucket
+	for range 2 {
+		wait, empty := l.take(start, user, chat)
+		assert.Zero(t, wait)
+		assert.Empty(t, empty)
+	}
+	wait, empty := l.take(start, user, chat)
+	assert.Equal(t, time.Second, wait)
+	assert.Equal(t, []string{"user:user1"}, empty)
+
+	//Check that refused events don't take tokens of other buckets
+	wait, _ = l.take(start, chat)
+	assert.Zero(t, wait)
+	wait, empty = l.take(start, chat)
+	assert.Equal(t, 100*time.Millisecond, wait)
+	assert.Equal(t, []string{"chat:1"}, empty)
+
+	//Check that buckets refill over time
+	wait, _ = l.take(start.Add(time.Second), user, chat)
+	assert.Zero(t, wait)
+
+	//Check that refilled buckets are swept and disabled limits are ignored
+	l.take(start.Add(time.Hour), limitKey{key: "user:user2"})
+	assert.Empty(t, l.buckets)
+
+	//Parse rate limits
+	limit, err := ParseRateLimit("2.5:10")
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimit{Rate: 2.5, Burst: 10}, limit)
+	limit, err = ParseRateLimit("off")
+	assert.NoError(t, err)
+	assert.Zero(t, limit)
+	_, err = ParseRateLimit("5")
+	assert.Error(t, err)
+}
+
+func TestRateLimit(t *testing.T) {
+	//Create manager with a tight user limit
+	m, storage := newTestManager(t)
+	m.UserRateLimit = RateLimit{Rate: 0.001, Burst: 2}
+	m.MaxViolations = 3
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	sender := newTestClient(t, m, "user1")
+
+	//Send messages within the burst
+	for _, id := range []string{"1", "2"} {
+		m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, id, Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+		assert.Equal(t, EventAck, (<-sender.writer).Type)
+	}
+
+	//Check that the next message gets a slow down error with the time to wait
+	m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, "3", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	event := <-sender.writer
+	assertErrorEvent(t, event, "3", CodeSlowDown)
+	var payload ErrorPayload
+	assert.NoError(t, json.Unmarshal(event.Payload, &payload))
+	assert.Positive(t, payload.RetryAfter)
+
+	//Check that the client is disconnected after repeated violations
+	for _, id := range []string{"4", "5"} {
+		m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, id, Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	}
+	assert.Eventually(t, func() bool {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return !m.clients[sender]
+	}, time.Second, 10*time.Millisecond)
+	metrics := m.Metrics()
+	assert.Equal(t, int64(3), metrics.Limited)
+	assert.Equal(t, int64(1), metrics.Abusive)
+}
+
+func TestChatRateLimit(t *testing.T) {
+	//Create manager with a tight chat limit shared by two users
+	m, storage := newTestManager(t)
+	m.ChatRateLimit = RateLimit{Rate: 0.001, Burst: 2}
+	m.MaxViolations = 2
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	noisy, quiet := newTestClient(t, m, "user1"), newTestClient(t, m, "user2")
+
+	//Fill the chat's bucket by one user
+	for _, id := range []string{"1", "2"} {
+		m.handleEvent(context.Background(), noisy, testEvent(t, EventMessage, id, Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+		assert.Equal(t, EventAck, (<-noisy.writer).Type)
+		assert.Equal(t, EventMessage, (<-quiet.writer).Type)
+	}
+
+	//Check that the other user is only slowed down and stays connected however many times the chat limit is hit
+	for _, id := range []string{"3", "4", "5"} {
+		m.handleEvent(context.Background(), quiet, testEvent(t, EventMessage, id, Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+		assertErrorEvent(t, <-quiet.writer, id, CodeSlowDown)
+	}
+	m.mu.RLock()
+	assert.True(t, m.clients[quiet])
+	m.mu.RUnlock()
+	assert.Zero(t, quiet.violations.Load())
+	metrics := m.Metrics()
+	assert.Equal(t, int64(3), metrics.Limited)
+	assert.Zero(t, metrics.Abusive)
+}
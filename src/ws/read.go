@@ -0,0 +1,53 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+)
+
+// Read is the payload of read events. Clients send it with the sequence number of the last message they have read
+// and the server sends it to the other chat members with the reader's username
+type Read struct {
+	ChatId string `json:"chat_id"`
+	From   string `json:"from,omitempty"`
+	Seq    int64  `json:"seq"`
+}
+
+// MarkRead moves user's read position in the chat forward and sends a read receipt to the chat members.
+// Sender is the connection the request came from, it doesn't get the receipt. Sender is nil for requests made over http
+func (m *Manager) MarkRead(ctx context.Context, username, chatId string, seq int64, sender *Client) (*Read, error) {
+	//Check that user is a member of the chat
+	member, err := m.isMember(ctx, chatId, username)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, ErrForbidden
+	}
+
+	//Move read position
+	read, err := m.store.MarkRead(ctx, chatId, username, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	//Send receipt to other members and user's other connections
+	receipt := &Read{ChatId: chatId, From: username, Seq: read}
+	if err := m.broadcast(chatId, EventRead, receipt, sender); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// handleRead marks messages in a chat as read
+func (m *Manager) handleRead(ctx context.Context, c *Client, event Event) error {
+	var request Read
+	if err := decodePayload(event, &request); err != nil {
+		return err
+	}
+	if request.Seq < 0 {
+		return fmt.Errorf("%w: sequence number can't be negative", ErrBadRequest)
+	}
+	_, err := m.MarkRead(ctx, c.username, request.ChatId, request.Seq, c)
+	return err
+}
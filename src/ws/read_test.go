@@ -0,0 +1,46 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dafraer/messenger/src/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleRead(t *testing.T) {
+	//Create manager with in-memory storage
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := storage.SaveMessage(context.Background(), store.Message{ChatId: chatIdHex(chatId), From: "user1", Text: "hi", Time: 1})
+		assert.NoError(t, err)
+	}
+
+	//Connect author and two devices of the reader
+	author := newTestClient(t, m, "user1")
+	phone, laptop := newTestDevice(t, m, "user2", "phone"), newTestDevice(t, m, "user2", "laptop")
+
+	//Read messages and check that author and reader's other device get the receipt
+	m.handleEvent(context.Background(), phone, testEvent(t, EventRead, "1", Read{ChatId: chatIdHex(chatId), Seq: 2}))
+	for _, c := range []*Client{author, laptop} {
+		event := <-c.writer
+		assert.Equal(t, EventRead, event.Type)
+		var read Read
+		assert.NoError(t, json.Unmarshal(event.Payload, &read))
+		assert.Equal(t, Read{ChatId: chatIdHex(chatId), From: "user2", Seq: 2}, read)
+	}
+	assert.Empty(t, phone.writer)
+
+	//Check that read position is stored
+	counts, err := storage.GetUnreadCounts(context.Background(), "user2")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), counts[chatIdHex(chatId)])
+
+	//Check that outsiders can't send receipts
+	outsider := newTestClient(t, m, "user3")
+	m.handleEvent(context.Background(), outsider, testEvent(t, EventRead, "2", Read{ChatId: chatIdHex(chatId), Seq: 1}))
+	assertErrorEvent(t, <-outsider.writer, "2", CodeForbidden)
+}
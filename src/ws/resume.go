@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dafraer/messenger/src/store"
+)
+
+// resumeLimit is the maximum number of missed messages replayed per chat on reconnect.
+// Clients that missed more load the rest from the history
+const resumeLimit = 500
+
+// Resumed is the payload of resumed events. It is sent after missed messages of a chat were replayed
+type Resumed struct {
+	ChatId string `json:"chat_id"`
+	//Seq is the sequence number of the last replayed message
+	Seq int64 `json:"seq"`
+	//More is true if client missed more than resumeLimit messages
+	More bool `json:"more,omitempty"`
+}
+
+// ParseResume parses last seen sequence numbers sent in the websocket handshake
+// in the format chatId:seq,chatId:seq
+func ParseResume(value string) (map[string]int64, error) {
+	lastSeq := make(map[string]int64)
+	if value == "" {
+		return lastSeq, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		chatId, seq, ok := strings.Cut(pair, ":")
+		if !ok || chatId == "" {
+			return nil, fmt.Errorf("%w: invalid resume pair %q", ErrBadRequest, pair)
+		}
+		n, err := strconv.ParseInt(seq, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: invalid sequence number %q", ErrBadRequest, seq)
+		}
+		lastSeq[chatId] = n
+	}
+	return lastSeq, nil
+}
+
+// Resume queues messages the client missed since the last seen sequence numbers, so they are written
+// before live events. Membership is checked in the storage and messages the user has hidden are skipped,
+// the same way as in the history. Must be called after AddClient and before the client starts writing messages
+func (m *Manager) Resume(ctx context.Context, client *Client, lastSeq map[string]int64) error {
+	var missed []pendingEvent
+	replayed := make(map[string]bool)
+	for chatId, seq := range lastSeq {
+		//Skip chats where user isn't a member anymore
+		hidden, err := m.hiddenMessages(ctx, client.username, chatId)
+		if errors.Is(err, store.ErrNotFound) || errors.Is(err, ErrForbidden) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		//Load one extra message to know if client missed more than we replay
+		messages, err := m.store.GetMessagesSince(ctx, chatId, seq, resumeLimit+1)
+		if err != nil {
+			return err
+		}
+		resumed := Resumed{ChatId: chatId, Seq: seq, More: len(messages) > resumeLimit}
+		if resumed.More {
+			messages = messages[:resumeLimit]
+		}
+
+		for _, msg := range messages {
+			//Hidden messages count as seen so the client doesn't ask for them again
+			resumed.Seq = msg.Seq
+			if slices.Contains(hidden, msg.Id) {
+				continue
+			}
+			event, err := newEvent(EventMessage, newMessage(&msg))
+			if err != nil {
+				return err
+			}
+			missed = append(missed, pendingEvent{messageId: msg.Id, chatId: msg.ChatId, seq: msg.Seq, event: event})
+			replayed[msg.Id] = true
+		}
+
+		//Let the client know the chat is up to date
+		event, err := newEvent(EventResumed, resumed)
+		if err != nil {
+			return err
+		}
+		missed = append(missed, pendingEvent{event: event})
+	}
+
+	//Write missed messages first and skip unacknowledged ones that were just replayed
+	for _, pending := range client.replay {
+		if !replayed[pending.messageId] {
+			missed = append(missed, pending)
+		}
+	}
+	client.replay = missed
+	return nil
+}
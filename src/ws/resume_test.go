@@ -0,0 +1,93 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dafraer/messenger/src/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResume(t *testing.T) {
+	//Parse sequence numbers of two chats
+	lastSeq, err := ParseResume("a:1,b:20")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"a": 1, "b": 20}, lastSeq)
+
+	//Check that empty value means nothing to resume
+	lastSeq, err = ParseResume("")
+	assert.NoError(t, err)
+	assert.Empty(t, lastSeq)
+
+	//Check that malformed values are refused
+	for _, value := range []string{"a", "a:x", ":1", "a:-1"} {
+		_, err = ParseResume(value)
+		assert.ErrorIs(t, err, ErrBadRequest)
+	}
+}
+
+func TestResume(t *testing.T) {
+	//Create manager with in-memory storage
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	otherId, err := storage.NewChat(context.Background(), []string{"user1", "user3"}, "user1")
+	assert.NoError(t, err)
+
+	//Save messages while user2 is offline
+	for _, text := range []string{"one", "two", "three"} {
+		_, err := storage.SaveMessage(context.Background(), store.Message{ChatId: chatIdHex(chatId), From: "user1", Text: text, Time: 1})
+		assert.NoError(t, err)
+	}
+
+	//Reconnect having seen the first message and ask for a chat user isn't a member of
+	c := newTestClient(t, m, "user2")
+	assert.NoError(t, m.Resume(context.Background(), c, map[string]int64{chatIdHex(chatId): 1, chatIdHex(otherId): 0}))
+
+	//Check that missed messages are replayed in order followed by the resumed event
+	assert.Len(t, c.replay, 3)
+	var texts []string
+	for _, pending := range c.replay[:2] {
+		var msg Message
+		assert.NoError(t, json.Unmarshal(pending.event.Payload, &msg))
+		texts = append(texts, msg.Text)
+	}
+	assert.Equal(t, []string{"two", "three"}, texts)
+	assert.Equal(t, EventResumed, c.replay[2].event.Type)
+	var resumed Resumed
+	assert.NoError(t, json.Unmarshal(c.replay[2].event.Payload, &resumed))
+	assert.Equal(t, Resumed{ChatId: chatIdHex(chatId), Seq: 3}, resumed)
+}
+
+func TestResumeHidden(t *testing.T) {
+	//Create manager with in-memory storage and save messages while user2 is offline
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	var saved []*store.Message
+	for _, text := range []string{"one", "two"} {
+		msg, err := storage.SaveMessage(context.Background(), store.Message{ChatId: chatIdHex(chatId), From: "user1", Text: text, Time: 1})
+		assert.NoError(t, err)
+		saved = append(saved, msg)
+	}
+
+	//Hide the first message and check that only the second one is replayed
+	assert.NoError(t, storage.HideMessage(context.Background(), chatIdHex(chatId), saved[0].Id, "user2"))
+	c := newTestClient(t, m, "user2")
+	assert.NoError(t, m.Resume(context.Background(), c, map[string]int64{chatIdHex(chatId): 0}))
+	assert.Len(t, c.replay, 2)
+	assert.Equal(t, saved[1].Id, c.replay[0].messageId)
+	var resumed Resumed
+	assert.NoError(t, json.Unmarshal(c.replay[1].event.Payload, &resumed))
+	assert.Equal(t, Resumed{ChatId: chatIdHex(chatId), Seq: 2}, resumed)
+
+	//Remove the user without notifying the manager and check that the chat isn't resumed from the cache
+	member, err := m.isMember(context.Background(), chatIdHex(chatId), "user2")
+	assert.NoError(t, err)
+	assert.True(t, member)
+	assert.NoError(t, storage.RemoveUserFromChat(context.Background(), "user2", chatIdHex(chatId)))
+	c = newTestDevice(t, m, "user2", "phone")
+	assert.NoError(t, m.Resume(context.Background(), c, map[string]int64{chatIdHex(chatId): 0}))
+	assert.Empty(t, c.replay)
+}
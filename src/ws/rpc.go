@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dafraer/messenger/src/store"
+)
+
+// Built-in methods of request events. They use the same logic as the REST api
+const (
+	//MethodHistory returns chat messages, see HistoryParams
+	MethodHistory = "history"
+	//MethodChats returns chats of the user with unread message counts
+	MethodChats = "chats"
+	//MethodCreateChat creates a chat, see CreateChatParams
+	MethodCreateChat = "create_chat"
+	//MethodMarkRead marks messages as read and returns the read receipt, its params are Read
+	MethodMarkRead = "mark_read"
+)
+
+// Request is the payload of request events. The server replies with a response event with the same id
+// whose payload is the method result, or with an error event if the method fails
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// HistoryParams are params of the history method. Without before, after and limit the whole history is returned,
+// otherwise a page of messages sorted newest first
+type HistoryParams struct {
+	ChatId string `json:"chat_id"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// CreateChatParams are params of the create_chat method. The user who sends the request owns the chat
+type CreateChatParams struct {
+	Members []string `json:"members"`
+}
+
+// Method handles a request of the client and returns the result sent in the response
+type Method func(ctx context.Context, c *Client, params json.RawMessage) (any, error)
+
+// HandleMethod registers request method replacing the existing one
+func (m *Manager) HandleMethod(name string, method Method) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.methods[name] = method
+}
+
+// registerDefaultMethods registers the built-in request methods
+func (m *Manager) registerDefaultMethods() {
+	m.methods[MethodHistory] = m.callHistory
+	m.methods[MethodChats] = m.callChats
+	m.methods[MethodCreateChat] = m.callCreateChat
+	m.methods[MethodMarkRead] = m.callMarkRead
+}
+
+// handleRequest calls the request method and replies with its result
+func (m *Manager) handleRequest(ctx context.Context, c *Client, event Event) error {
+	var request Request
+	if err := decodePayload(event, &request); err != nil {
+		return err
+	}
+
+	//Responses are matched to requests by id
+	if event.Id == "" {
+		return fmt.Errorf("%w: request id is required", ErrBadRequest)
+	}
+
+	m.mu.RLock()
+	method, ok := m.methods[request.Method]
+	m.mu.RUnlock()
+	if !ok {
+		return &codeError{code: CodeUnknownMethod, message: fmt.Sprintf("unknown method %q", request.Method)}
+	}
+
+	result, err := method(ctx, c, request.Params)
+	if err != nil {
+		return err
+	}
+	response, err := newEvent(EventResponse, result)
+	if err != nil {
+		return err
+	}
+	response.Id = event.Id
+	c.send(response)
+	return nil
+}
+
+// decodeParams parses request params
+func decodeParams(params json.RawMessage, v any) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return nil
+}
+
+// callHistory returns the whole history or a page of messages of the chat
+func (m *Manager) callHistory(ctx context.Context, c *Client, params json.RawMessage) (any, error) {
+	var request HistoryParams
+	if err := decodeParams(params, &request); err != nil {
+		return nil, err
+	}
+	if request.Before == "" && request.After == "" && request.Limit == 0 {
+		return m.History(ctx, c.username, request.ChatId)
+	}
+	return m.HistoryPage(ctx, c.username, request.ChatId, store.MessageQuery{
+		Before: request.Before,
+		After:  request.After,
+		Limit:  request.Limit,
+	})
+}
+
+// callChats returns chats of the user
+func (m *Manager) callChats(ctx context.Context, c *Client, params json.RawMessage) (any, error) {
+	return m.Chats(ctx, c.username)
+}
+
+// callCreateChat creates a chat owned by the user and returns its id
+func (m *Manager) callCreateChat(ctx context.Context, c *Client, params json.RawMessage) (any, error) {
+	var request CreateChatParams
+	if err := decodeParams(params, &request); err != nil {
+		return nil, err
+	}
+	return m.CreateChat(ctx, c.username, request.Members)
+}
+
+// callMarkRead marks messages as read and returns the read receipt
+func (m *Manager) callMarkRead(ctx context.Context, c *Client, params json.RawMessage) (any, error) {
+	var request Read
+	if err := decodeParams(params, &request); err != nil {
+		return nil, err
+	}
+	if request.Seq < 0 {
+		return nil, fmt.Errorf("%w: sequence number can't be negative", ErrBadRequest)
+	}
+	return m.MarkRead(ctx, c.username, request.ChatId, request.Seq, c)
+}
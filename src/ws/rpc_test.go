@@ -0,0 +1,75 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dafraer/messenger/src/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequests(t *testing.T) {
+	//Create manager and connect two users
+	m, storage := newTestManager(t)
+	c1, c2 := newTestClient(t, m, "user1"), newTestClient(t, m, "user2")
+
+	//call sends a request and returns the reply
+	call := func(c *Client, id, method string, params any) Event {
+		data, err := json.Marshal(params)
+		assert.NoError(t, err)
+		m.handleEvent(context.Background(), c, testEvent(t, EventRequest, id, Request{Method: method, Params: data}))
+		return <-c.writer
+	}
+
+	//Create chat and check that the response carries its id and members are subscribed
+	event := call(c1, "1", MethodCreateChat, CreateChatParams{Members: []string{"user1", "user2"}})
+	assert.Equal(t, EventResponse, event.Type)
+	assert.Equal(t, "1", event.Id)
+	var chatId string
+	assert.NoError(t, json.Unmarshal(event.Payload, &chatId))
+	assert.NotEmpty(t, c2.hubs[chatId])
+
+	//Send messages and list chats with unread counts
+	for _, text := range []string{"hello", "world"} {
+		_, err := storage.SaveMessage(context.Background(), store.Message{ChatId: chatId, From: "user1", Text: text})
+		assert.NoError(t, err)
+	}
+	event = call(c2, "2", MethodChats, nil)
+	assert.Equal(t, EventResponse, event.Type)
+	var chats []ChatSummary
+	assert.NoError(t, json.Unmarshal(event.Payload, &chats))
+	assert.Len(t, chats, 1)
+	assert.Equal(t, int64(2), chats[0].Unread)
+
+	//Get the whole history and a page of it
+	event = call(c2, "3", MethodHistory, HistoryParams{ChatId: chatId})
+	var messages []store.Message
+	assert.NoError(t, json.Unmarshal(event.Payload, &messages))
+	assert.Len(t, messages, 2)
+	event = call(c2, "4", MethodHistory, HistoryParams{ChatId: chatId, Limit: 1})
+	var page store.MessagePage
+	assert.NoError(t, json.Unmarshal(event.Payload, &page))
+	assert.Len(t, page.Messages, 1)
+	assert.Equal(t, "world", page.Messages[0].Text)
+
+	//Mark messages as read and check that the receipt is the response and the other member is notified
+	event = call(c2, "5", MethodMarkRead, Read{ChatId: chatId, Seq: 2})
+	assert.Equal(t, EventResponse, event.Type)
+	var read Read
+	assert.NoError(t, json.Unmarshal(event.Payload, &read))
+	assert.Equal(t, Read{ChatId: chatId, From: "user2", Seq: 2}, read)
+	assert.Equal(t, EventRead, (<-c1.writer).Type)
+
+	//Check that failed requests get error events with the request id
+	assertErrorEvent(t, call(newTestClient(t, m, "user3"), "6", MethodHistory, HistoryParams{ChatId: chatId}), "6", CodeForbidden)
+	assertErrorEvent(t, call(c1, "7", "unknown", nil), "7", CodeUnknownMethod)
+	assertErrorEvent(t, call(c1, "", MethodChats, nil), "", CodeBadRequest)
+
+	//Check that a member removed without notifying the manager can't read the history from the cache
+	assert.NoError(t, storage.RemoveUserFromChat(context.Background(), "user2", chatId))
+	member, err := m.isMember(context.Background(), chatId, "user2")
+	assert.NoError(t, err)
+	assert.True(t, member)
+	assertErrorEvent(t, call(c2, "8", MethodHistory, HistoryParams{ChatId: chatId}), "8", CodeForbidden)
+}
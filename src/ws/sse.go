@@ -0,0 +1,157 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrStreamingUnsupported is returned when response writer can't flush server-sent events
+var ErrStreamingUnsupported = errors.New("streaming is not supported")
+
+// ErrClientNotFound is returned when event is sent on behalf of a client that isn't connected
+var ErrClientNotFound = errors.New("client not found")
+
+// Connected is the payload of connected events sent to clients of transports that send events with separate requests
+type Connected struct {
+	//ClientId must be sent with events the client sends, see ReceiveEvent
+	ClientId string `json:"client_id"`
+}
+
+// sseTransport writes events as server-sent events. Every event is written as a single data line
+// holding the same json as websocket messages
+type sseTransport struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// WriteEvent writes event and flushes it to the client
+func (t *sseTransport) WriteEvent(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return t.write(fmt.Sprintf("data: %s\n\n", data))
+}
+
+// Close does nothing, the response is finished when ServeEvents returns
+func (t *sseTransport) Close() error {
+	return nil
+}
+
+// ping writes a comment that keeps proxies from closing idle connections
+func (t *sseTransport) ping() error {
+	return t.write(": ping\n\n")
+}
+
+// write writes text to the response and flushes it
+func (t *sseTransport) write(text string) error {
+	if _, err := t.w.Write([]byte(text)); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+// NewSSEClient creates new client that receives events as server-sent events written to the response.
+// Events from the client are sent with separate requests, see ReceiveEvent
+func NewSSEClient(w http.ResponseWriter, manager *Manager, username, device string) (*Client, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, ErrStreamingUnsupported
+	}
+	return &Client{
+		id:        newId(),
+		username:  username,
+		device:    device,
+		transport: &sseTransport{w: w, flusher: flusher},
+		done:      make(chan struct{}),
+		manager:   manager,
+		writer:    make(chan Event, manager.SendBuffer),
+		logger:    manager.logger,
+	}, nil
+}
+
+// ServeEvents writes events to a client created by NewSSEClient until ctx is done or the client is removed.
+// It must be called by the request handler after the client is added to the manager
+func (c *Client) ServeEvents(ctx context.Context) {
+	//Gracefully remove the client
+	defer func() {
+		if err := c.manager.RemoveClient(context.Background(), c); err != nil {
+			c.logger.Errorw("Error removing client", "error", err)
+		}
+	}()
+
+	transport, ok := c.transport.(*sseTransport)
+	if !ok {
+		c.logger.Errorw("Error serving events", "error", ErrStreamingUnsupported)
+		return
+	}
+
+	//Start the stream, tell the client its id and what the server supports
+	header := transport.w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	//Disable response buffering of nginx
+	header.Set("X-Accel-Buffering", "no")
+	transport.w.WriteHeader(http.StatusOK)
+	events, err := c.greeting()
+	if err != nil {
+		c.logger.Errorw("Error creating event", "error", err)
+		return
+	}
+	for _, event := range events {
+		if err := transport.WriteEvent(event); err != nil {
+			c.logger.Errorw("Error writing message:", "error", err)
+			return
+		}
+	}
+
+	c.writeEvents(ctx.Done(), transport.ping)
+}
+
+// greeting returns connected and hello events sent first to clients that send events with separate requests
+func (c *Client) greeting() ([]Event, error) {
+	connected, err := newEvent(EventConnected, Connected{ClientId: c.id})
+	if err != nil {
+		return nil, err
+	}
+	hello, err := c.manager.newHelloEvent("")
+	if err != nil {
+		return nil, err
+	}
+	return []Event{connected, hello}, nil
+}
+
+// ReceiveEvent handles event the user's client sent with a separate request instead of its connection.
+// Replies and errors of the event are written to the client the same way as for websocket clients
+func (m *Manager) ReceiveEvent(ctx context.Context, username, clientId string, data []byte) error {
+	//Find the client of the user
+	c, err := m.Client(username, clientId)
+	if err != nil {
+		return err
+	}
+
+	//Decode the event
+	event, err := decodeEvent(data)
+	if err != nil {
+		return err
+	}
+
+	//Route event to its handler
+	m.handleEvent(ctx, c, event)
+	return nil
+}
+
+// Client returns connected client of the user by id
+func (m *Manager) Client(username, clientId string) (*Client, error) {
+	m.mu.RLock()
+	c, ok := m.ids[clientId]
+	m.mu.RUnlock()
+	if !ok || c.username != username {
+		return nil, ErrClientNotFound
+	}
+	return c, nil
+}
@@ -0,0 +1,188 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dafraer/messenger/src/store"
+)
+
+// MessageWatcher is implemented by storages that stream messages saved by any server instance
+type MessageWatcher interface {
+	WatchMessages(ctx context.Context, name string, handler func(store.MessageChange)) error
+}
+
+// maxWatchBackoff is the longest delay before a failed stream is restarted
+const maxWatchBackoff = time.Minute
+
+// localTTL is how long sent changes are remembered, so a change isn't sent again when it comes late from the stream
+const localTTL = 10 * time.Minute
+
+// WatchMessages delivers messages saved, edited or deleted by other server instances to clients of this manager
+// until ctx is done. It's an alternative to a broker for deployments where all instances share the storage.
+// The name identifies the instance so the stream continues where it stopped after a restart.
+// The stream is restarted with exponential backoff whenever it fails.
+// Only message changes are streamed, members removed from a chat on another instance keep getting its messages until they reconnect
+func (m *Manager) WatchMessages(ctx context.Context, watcher MessageWatcher, name string) error {
+	m.watching.Store(true)
+	defer func() {
+		m.watching.Store(false)
+		m.localMu.Lock()
+		clear(m.local)
+		m.localMu.Unlock()
+	}()
+
+	backoff := m.watchBackoff
+	for {
+		started := time.Now()
+		err := watcher.WatchMessages(ctx, name, m.receiveChange)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		//Start over with the initial delay if the stream has been working for a while
+		if time.Since(started) > maxWatchBackoff {
+			backoff = m.watchBackoff
+		}
+		m.logger.Errorw("Error watching messages, restarting the stream", "error", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxWatchBackoff)
+	}
+}
+
+// changeKey identifies a message change
+func changeKey(kind string, message Message) string {
+	version := message.Seq
+	switch kind {
+	case store.ChangeEdit:
+		version = message.EditedAt
+	case store.ChangeDelete:
+		version = message.DeletedAt
+	}
+	return fmt.Sprintf("%s:%s:%d", kind, message.Id, version)
+}
+
+// claim remembers the change and reports whether it hasn't been sent by this manager yet. Changes made through
+// this manager are claimed after they're saved and the stream can deliver them before that,
+// so whichever claims the change first sends it. New messages are always claimed by the sending client first,
+// see startSending, because only it knows the sender's device whose clients must not get the message back
+func (m *Manager) claim(kind string, message Message) bool {
+	if !m.watching.Load() {
+		return true
+	}
+	now := time.Now()
+	key := changeKey(kind, message)
+	m.localMu.Lock()
+	defer m.localMu.Unlock()
+
+	//Forget expired changes
+	if now.Sub(m.localSwept) >= sweepInterval {
+		m.localSwept = now
+		for noted, expiry := range m.local {
+			if now.After(expiry) {
+				delete(m.local, noted)
+			}
+		}
+	}
+
+	if _, ok := m.local[key]; ok {
+		return false
+	}
+	m.local[key] = now.Add(localTTL)
+	return true
+}
+
+// startSending notes that the user's message is being saved in the chat, the stream doesn't claim new messages
+// of the user in the chat until the returned function is called after the message is claimed
+func (m *Manager) startSending(chatId, username string) func() {
+	if !m.watching.Load() {
+		return func() {}
+	}
+	key := chatId + ":" + username
+	m.localMu.Lock()
+	m.sending[key]++
+	m.localMu.Unlock()
+
+	return func() {
+		m.localMu.Lock()
+		m.sending[key]--
+		if m.sending[key] == 0 {
+			delete(m.sending, key)
+		}
+		m.localMu.Unlock()
+		m.sent.Broadcast()
+	}
+}
+
+// waitSending waits until messages of the user being saved in the chat by this manager are claimed
+func (m *Manager) waitSending(chatId, username string) {
+	key := chatId + ":" + username
+	m.localMu.Lock()
+	defer m.localMu.Unlock()
+	for m.sending[key] > 0 {
+		m.sent.Wait()
+	}
+}
+
+// receiveChange sends message change made by another instance to clients of this manager
+func (m *Manager) receiveChange(change store.MessageChange) {
+	message := newMessage(&change.Message)
+
+	//Skip changes already sent by this manager
+	if change.Kind == store.ChangeInsert {
+		m.waitSending(message.ChatId, message.From)
+	}
+	if !m.claim(change.Kind, message) {
+		return
+	}
+
+	eventType := EventMessage
+	switch change.Kind {
+	case store.ChangeEdit:
+		eventType = EventEdit
+	case store.ChangeDelete:
+		eventType = EventDelete
+	}
+	event, err := newEvent(eventType, message)
+	if err != nil {
+		m.logger.Errorw("Error creating event", "error", err)
+		return
+	}
+
+	//Chats created on other instances are unknown until their first message,
+	//so members are loaded and their connected clients subscribed
+	if err := m.loadChat(context.TODO(), message.ChatId); err != nil {
+		m.logger.Errorw("Error loading chat", "error", err)
+		return
+	}
+
+	if eventType == EventMessage {
+		m.deliverLocal(message, event, deviceKey{}, nil)
+		return
+	}
+	m.sendLocal([]string{message.ChatId}, event, func(*Client) bool { return true })
+}
+
+// loadChat caches members of the chat and subscribes their connected clients unless members are cached already
+func (m *Manager) loadChat(ctx context.Context, chatId string) error {
+	if h := m.hubs.lookup(chatId); h != nil {
+		h.mu.RLock()
+		loaded := h.members != nil
+		h.mu.RUnlock()
+		if loaded {
+			return nil
+		}
+	}
+
+	chat, err := m.store.GetChat(ctx, chatId)
+	if err != nil {
+		return err
+	}
+	m.addChatClients(chatId, chat.Members)
+	return nil
+}
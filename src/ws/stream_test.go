@@ -0,0 +1,154 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dafraer/messenger/src/store"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// failingWatcher fails the given number of times and then passes changes to its testWatcher
+type failingWatcher struct {
+	failures atomic.Int32
+	watcher  testWatcher
+}
+
+func (w *failingWatcher) WatchMessages(ctx context.Context, name string, handler func(store.MessageChange)) error {
+	if w.failures.Add(-1) >= 0 {
+		return errors.New("stream failed")
+	}
+	return w.watcher.WatchMessages(ctx, name, handler)
+}
+
+// testWatcher passes changes sent to its channel to the handler until ctx is done
+type testWatcher chan store.MessageChange
+
+func (w testWatcher) WatchMessages(ctx context.Context, name string, handler func(store.MessageChange)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case change := <-w:
+			handler(change)
+		}
+	}
+}
+
+func TestWatchMessages(t *testing.T) {
+	//Create manager watching changes with a stream that fails twice before it starts
+	m, storage := newTestManager(t)
+	m.watchBackoff = time.Millisecond
+	watcher := make(testWatcher)
+	failing := &failingWatcher{watcher: watcher}
+	failing.failures.Store(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.WatchMessages(ctx, failing, "test") }()
+
+	//Connect the receiver before the chat is created on another instance
+	receiver := newTestClient(t, m, "user2")
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+
+	//Check that message saved by another instance is delivered and queued
+	saved, err := storage.SaveMessage(context.Background(), store.Message{ChatId: chatIdHex(chatId), From: "user1", Text: "hello"})
+	assert.NoError(t, err)
+	watcher <- store.MessageChange{Kind: store.ChangeInsert, Message: *saved}
+	event := <-receiver.writer
+	assert.Equal(t, EventMessage, event.Type)
+	var msg Message
+	assert.NoError(t, json.Unmarshal(event.Payload, &msg))
+	assert.Equal(t, saved.Id, msg.Id)
+	assert.Equal(t, 1, m.Devices("user2")[0].Pending)
+
+	//Check that changes made through this manager aren't sent twice
+	sender := newTestClient(t, m, "user1")
+	m.handleEvent(context.Background(), sender, testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "local"}))
+	assert.Equal(t, EventAck, (<-sender.writer).Type)
+	assert.Equal(t, EventMessage, (<-receiver.writer).Type)
+	edited, err := m.EditMessage(context.Background(), "user1", chatIdHex(chatId), saved.Id, "edited")
+	assert.NoError(t, err)
+	assert.Equal(t, EventEdit, (<-receiver.writer).Type)
+	local, err := storage.GetMessagesSince(context.Background(), chatIdHex(chatId), 1, 1)
+	assert.NoError(t, err)
+	watcher <- store.MessageChange{Kind: store.ChangeInsert, Message: local[0]}
+	watcher <- store.MessageChange{Kind: store.ChangeEdit, Message: *edited}
+
+	//Check that deletes made by another instance are sent
+	deleted, err := storage.DeleteMessage(context.Background(), chatIdHex(chatId), saved.Id, 1)
+	assert.NoError(t, err)
+	watcher <- store.MessageChange{Kind: store.ChangeDelete, Message: *deleted}
+	assert.Equal(t, EventDelete, (<-receiver.writer).Type)
+
+	//Check that a local message isn't sent again if the stream delivers it before it's claimed locally
+	raced, err := storage.SaveMessage(context.Background(), store.Message{ChatId: chatIdHex(chatId), From: "user1", Text: "raced"})
+	assert.NoError(t, err)
+	watcher <- store.MessageChange{Kind: store.ChangeInsert, Message: *raced}
+	assert.Equal(t, EventMessage, (<-receiver.writer).Type)
+	assert.NoError(t, m.deliver(newMessage(raced), sender))
+	assert.Empty(t, receiver.writer)
+	assert.Negative(t, failing.failures.Load())
+
+	//Check that watching stops with the context and sent changes are forgotten
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	m.localMu.Lock()
+	assert.Empty(t, m.local)
+	m.localMu.Unlock()
+}
+
+// racingStore passes saved messages to the stream before SaveMessage returns, as a fast change stream would
+type racingStore struct {
+	*store.MemoryStore
+	watcher testWatcher
+}
+
+func (s *racingStore) SaveMessage(ctx context.Context, msg store.Message) (*store.Message, error) {
+	saved, err := s.MemoryStore.SaveMessage(ctx, msg)
+	if err == nil {
+		s.watcher <- store.MessageChange{Kind: store.ChangeInsert, Message: *saved}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return saved, err
+}
+
+func TestWatchMessagesRace(t *testing.T) {
+	//Create manager whose stream gets messages before they are saved locally
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	watcher := make(testWatcher)
+	storage := &racingStore{MemoryStore: store.NewMemoryStore(), watcher: watcher}
+	m := NewManager(logger.Sugar(), storage)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.WatchMessages(ctx, watcher, "test") }()
+	assert.Eventually(t, m.watching.Load, time.Second, time.Millisecond)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	laptop, phone := newTestDevice(t, m, "user1", "laptop"), newTestDevice(t, m, "user1", "phone")
+	receiver := newTestClient(t, m, "user2")
+
+	//Send message and wait until the stream has handled it by passing it again
+	m.handleEvent(context.Background(), laptop, testEvent(t, EventMessage, "1", Message{ChatId: chatIdHex(chatId), Text: "hello"}))
+	local, err := storage.GetMessagesSince(context.Background(), chatIdHex(chatId), 0, 1)
+	assert.NoError(t, err)
+	watcher <- store.MessageChange{Kind: store.ChangeInsert, Message: local[0]}
+
+	//Check that the message is sent once and isn't echoed or queued to the sending device
+	assert.Equal(t, EventAck, (<-laptop.writer).Type)
+	assert.Empty(t, laptop.writer)
+	assert.Equal(t, EventMessage, (<-phone.writer).Type)
+	assert.Equal(t, EventMessage, (<-receiver.writer).Type)
+	assert.Empty(t, phone.writer)
+	assert.Empty(t, receiver.writer)
+	assert.Zero(t, m.Devices("user1")[0].Pending)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,47 @@
+package ws
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// Transport writes events to a client connection. Events are routed to clients the same way
+// for every transport, only the framing differs
+type Transport interface {
+	WriteEvent(event Event) error
+	// Close closes the connection when the client is removed from the manager
+	Close() error
+}
+
+// wsTransport writes events as websocket messages encoded by the codec of the connection
+type wsTransport struct {
+	conn  *websocket.Conn
+	codec Codec
+}
+
+// WriteEvent encodes event and writes it to the websocket connection
+func (t wsTransport) WriteEvent(event Event) error {
+	data, err := t.codec.Encode(event)
+	if err != nil || data == nil {
+		return err
+	}
+	return t.conn.WriteMessage(t.codec.MessageType(), data)
+}
+
+// Close closes the websocket connection
+func (t wsTransport) Close() error {
+	return t.conn.Close()
+}
+
+// close stops writing events and closes the client's connection. Must be called once
+func (c *Client) close() error {
+	if c.done != nil {
+		close(c.done)
+	}
+	if c.poll != nil {
+		c.poll.idle.Stop()
+	}
+	if c.transport == nil {
+		return nil
+	}
+	return c.transport.Close()
+}
@@ -0,0 +1,125 @@
+package ws
+
+import (
+	"context"
+	"time"
+)
+
+// typingTimeout is how long a user is shown as typing after the last typing_start event.
+// Clients that keep typing should repeat typing_start more often than that
+var typingTimeout = time.Second * 6
+
+// Typing is the payload of typing_start and typing_stop events
+type Typing struct {
+	ChatId string `json:"chat_id"`
+	From   string `json:"from,omitempty"`
+}
+
+// typingKey identifies a user typing in a chat
+type typingKey struct {
+	chatId   string
+	username string
+}
+
+// typingTimer stops typing after typingTimeout. Its callback compares the pointer with the current timer
+// of the user, so it must be allocated before the timer starts
+type typingTimer struct {
+	timer *time.Timer
+}
+
+// handleTypingStart relays typing_start to other chat members. Typing stops automatically
+// if the client doesn't send typing_start or typing_stop again within typingTimeout
+func (m *Manager) handleTypingStart(ctx context.Context, c *Client, event Event) error {
+	key, err := m.typingKey(ctx, c, event)
+	if err != nil {
+		return err
+	}
+
+	h := m.hubs.hub(key.chatId)
+	h.mu.Lock()
+	current, typing := h.typing[key.username]
+	if !typing || !current.timer.Stop() {
+		//Start a new expiry timer. If the old one has already fired its callback sees the new timer and does nothing
+		expiry := &typingTimer{}
+		expiry.timer = time.AfterFunc(typingTimeout, func() {
+			m.expireTyping(key, expiry)
+		})
+		h.typing[key.username] = expiry
+	} else {
+		current.timer.Reset(typingTimeout)
+	}
+	h.mu.Unlock()
+
+	//Let members know only when user starts typing
+	if typing {
+		return nil
+	}
+	return m.broadcast(key.chatId, EventTypingStart, Typing{ChatId: key.chatId, From: key.username}, c)
+}
+
+// handleTypingStop relays typing_stop to other chat members
+func (m *Manager) handleTypingStop(ctx context.Context, c *Client, event Event) error {
+	key, err := m.typingKey(ctx, c, event)
+	if err != nil {
+		return err
+	}
+	return m.stopTyping(key, c)
+}
+
+// typingKey decodes typing event and checks that client's user is a member of the chat
+func (m *Manager) typingKey(ctx context.Context, c *Client, event Event) (typingKey, error) {
+	var request Typing
+	if err := decodePayload(event, &request); err != nil {
+		return typingKey{}, err
+	}
+
+	member, err := m.isMember(ctx, request.ChatId, c.username)
+	if err != nil {
+		return typingKey{}, err
+	}
+	if !member {
+		return typingKey{}, ErrForbidden
+	}
+	return typingKey{chatId: request.ChatId, username: c.username}, nil
+}
+
+// stopTyping stops the expiry timer and sends typing_stop to chat members if user was typing
+func (m *Manager) stopTyping(key typingKey, sender *Client) error {
+	h := m.hubs.lookup(key.chatId)
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	current, typing := h.typing[key.username]
+	if typing {
+		current.timer.Stop()
+		delete(h.typing, key.username)
+	}
+	h.mu.Unlock()
+
+	if !typing {
+		return nil
+	}
+	return m.broadcast(key.chatId, EventTypingStop, Typing{ChatId: key.chatId, From: key.username}, sender)
+}
+
+// expireTyping stops typing when typing_stop never arrived
+func (m *Manager) expireTyping(key typingKey, expiry *typingTimer) {
+	h := m.hubs.lookup(key.chatId)
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	expired := h.typing[key.username] == expiry
+	if expired {
+		delete(h.typing, key.username)
+	}
+	h.mu.Unlock()
+
+	if !expired {
+		return
+	}
+	if err := m.broadcast(key.chatId, EventTypingStop, Typing{ChatId: key.chatId, From: key.username}, nil); err != nil {
+		m.logger.Errorw("Error sending typing stop", "error", err)
+	}
+}
@@ -0,0 +1,64 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTyping(t *testing.T) {
+	//Create manager with in-memory storage
+	m, storage := newTestManager(t)
+	chatId, err := storage.NewChat(context.Background(), []string{"user1", "user2"}, "user1")
+	assert.NoError(t, err)
+	typing := Typing{ChatId: chatIdHex(chatId)}
+
+	//Connect both chat members
+	typist, reader := newTestClient(t, m, "user1"), newTestClient(t, m, "user2")
+
+	//Start typing twice and check that the other member is notified once
+	m.handleEvent(context.Background(), typist, testEvent(t, EventTypingStart, "", typing))
+	m.handleEvent(context.Background(), typist, testEvent(t, EventTypingStart, "", typing))
+	assertTypingEvent(t, <-reader.writer, EventTypingStart, "user1")
+	assert.Empty(t, reader.writer)
+
+	//Stop typing and check that stop is relayed
+	m.handleEvent(context.Background(), typist, testEvent(t, EventTypingStop, "", typing))
+	assertTypingEvent(t, <-reader.writer, EventTypingStop, "user1")
+
+	//Check that sending a message stops typing
+	m.handleEvent(context.Background(), typist, testEvent(t, EventTypingStart, "", typing))
+	assertTypingEvent(t, <-reader.writer, EventTypingStart, "user1")
+	m.handleEvent(context.Background(), typist, testEvent(t, EventMessage, "", Message{ChatId: chatIdHex(chatId), Text: "hi"}))
+	assertTypingEvent(t, <-reader.writer, EventTypingStop, "user1")
+	assert.Equal(t, EventMessage, (<-reader.writer).Type)
+	assert.Equal(t, EventAck, (<-typist.writer).Type)
+
+	//Check that typing expires if stop never arrives
+	typingTimeout = time.Millisecond * 10
+	t.Cleanup(func() { typingTimeout = time.Second * 6 })
+	m.handleEvent(context.Background(), reader, testEvent(t, EventTypingStart, "", typing))
+	assertTypingEvent(t, <-typist.writer, EventTypingStart, "user2")
+	select {
+	case event := <-typist.writer:
+		assertTypingEvent(t, event, EventTypingStop, "user2")
+	case <-time.After(time.Second):
+		t.Fatal("typing didn't expire")
+	}
+
+	//Check that outsiders can't send typing events
+	outsider := newTestClient(t, m, "user3")
+	m.handleEvent(context.Background(), outsider, testEvent(t, EventTypingStart, "1", typing))
+	assertErrorEvent(t, <-outsider.writer, "1", CodeForbidden)
+}
+
+// assertTypingEvent checks that event is a typing event of the user
+func assertTypingEvent(t *testing.T, event Event, eventType, username string) {
+	assert.Equal(t, eventType, event.Type)
+	var typing Typing
+	assert.NoError(t, json.Unmarshal(event.Payload, &typing))
+	assert.Equal(t, username, typing.From)
+}